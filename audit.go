@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const auditLogFile = "data/audit.log"
+
+// AuditChange is a single field that differs between the before and after state
+type AuditChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry describes one administrative change
+type AuditEntry struct {
+	Time     time.Time       `json:"time"`
+	Actor    string          `json:"actor"`
+	IP       string          `json:"ip"`
+	Action   string          `json:"action"` // create, update, delete, ...
+	Entity   string          `json:"entity"` // banner, app, reservation, ...
+	EntityID string          `json:"entity_id,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+	Changes  []AuditChange   `json:"changes,omitempty"`
+}
+
+var auditLock sync.Mutex
+
+// writeAudit appends an entry to the audit log. before and after are the
+// entity states around the change; either may be nil for creates and deletes.
+func writeAudit(r *http.Request, action, entity, entityID string, before, after interface{}) {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Actor:    auditActor(r),
+		IP:       clientIP(r),
+		Action:   action,
+		Entity:   entity,
+		EntityID: entityID,
+	}
+
+	var beforeMap, afterMap map[string]interface{}
+	if before != nil {
+		entry.Before, beforeMap = auditSnapshot(before)
+	}
+	if after != nil {
+		entry.After, afterMap = auditSnapshot(after)
+	}
+	entry.Changes = diffFields(beforeMap, afterMap)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling audit entry: %v", err)
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening audit log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// auditActor returns the admin performing the request. Public routes do not
+// run through the auth middleware, so the credentials are checked directly.
+func auditActor(r *http.Request) string {
+	if username := requestUsername(r); username != "" {
+		return username
+	}
+	if claims, err := authenticateRequest(r); err == nil {
+		return claims.Username
+	}
+	return "anonymous"
+}
+
+// auditSnapshot returns the JSON form of v and its flattened fields
+func auditSnapshot(v interface{}) (json.RawMessage, map[string]interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling audit snapshot: %v", err)
+		return nil, nil
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return data, nil
+	}
+
+	fields := make(map[string]interface{})
+	flattenFields("", decoded, fields)
+	return data, fields
+}
+
+// flattenFields turns nested objects into dotted keys, e.g. Style.TextColor
+func flattenFields(prefix string, v interface{}, out map[string]interface{}) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		out[prefix] = v
+		return
+	}
+	for key, value := range obj {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenFields(key, value, out)
+	}
+}
+
+// diffFields lists the fields whose values differ, sorted by name
+func diffFields(before, after map[string]interface{}) []AuditChange {
+	var changes []AuditChange
+	for field, b := range before {
+		a, ok := after[field]
+		if !ok || !reflect.DeepEqual(a, b) {
+			changes = append(changes, AuditChange{Field: field, Before: b, After: a})
+		}
+	}
+	for field, a := range after {
+		if _, ok := before[field]; !ok {
+			changes = append(changes, AuditChange{Field: field, After: a})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// auditFilter holds the query parameters of GET /api/audit
+type auditFilter struct {
+	Actor    string
+	Entity   string
+	EntityID string
+	Action   string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+func (f auditFilter) match(e AuditEntry) bool {
+	if f.Actor != "" && !strings.EqualFold(e.Actor, f.Actor) {
+		return false
+	}
+	if f.Entity != "" && e.Entity != f.Entity {
+		return false
+	}
+	if f.EntityID != "" && e.EntityID != f.EntityID {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// parseAuditTime accepts RFC 3339 timestamps or plain dates (YYYY-MM-DD)
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// readAuditLog returns matching entries, newest first
+func readAuditLog(filter auditFilter) ([]AuditEntry, error) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.Open(auditLogFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []AuditEntry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("Skipping malformed audit entry: %v", err)
+			continue
+		}
+		if filter.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+// GetAuditHandler lists audit entries filtered by actor, entity, entity_id,
+// action, from and to. With format=csv the result is exported as CSV.
+func GetAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := auditFilter{
+		Actor:    q.Get("actor"),
+		Entity:   q.Get("entity"),
+		EntityID: q.Get("entity_id"),
+		Action:   q.Get("action"),
+		Limit:    parseIntOrDefault(q.Get("limit"), 100),
+	}
+
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := q.Get(name); value != "" {
+			t, err := parseAuditTime(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"Invalid %s parameter"}`, name), http.StatusBadRequest)
+				return
+			}
+			*target = t
+		}
+	}
+
+	if q.Get("format") == "csv" {
+		// Exports include everything unless a limit was given explicitly
+		if q.Get("limit") == "" {
+			filter.Limit = 0
+		}
+	}
+
+	entries, err := readAuditLog(filter)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		http.Error(w, `{"error":"Failed to read audit log"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		writeAuditCSV(w, entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("Error encoding audit entries: %v", err)
+	}
+}
+
+func writeAuditCSV(w http.ResponseWriter, entries []AuditEntry) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.csv"`, time.Now().Format("2006-01-02")))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "actor", "ip", "action", "entity", "entity_id", "changes"})
+	for _, e := range entries {
+		changes := make([]string, 0, len(e.Changes))
+		for _, c := range e.Changes {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", c.Field, auditValue(c.Before), auditValue(c.After)))
+		}
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339),
+			csvText(e.Actor),
+			csvText(e.IP),
+			csvText(e.Action),
+			csvText(e.Entity),
+			csvText(e.EntityID),
+			csvText(strings.Join(changes, "; ")),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error writing audit CSV: %v", err)
+	}
+}
+
+func auditValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		return strconv.Quote(value)
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
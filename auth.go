@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -16,30 +16,51 @@ import (
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Mode "cookie" issues the session as an HttpOnly cookie instead of a bearer token
+	Mode string `json:"mode,omitempty"`
 }
 
 type Claims struct {
 	Username string `json:"username"`
+	// Purpose is empty for full session tokens and "mfa" for the
+	// intermediate token of a two-step login
+	Purpose string `json:"purpose,omitempty"`
+	// CSRF is set for cookie sessions; mutating requests must echo it
+	// in the X-CSRF-Token header
+	CSRF string `json:"csrf,omitempty"`
 	jwt.RegisteredClaims
 }
 
 var (
-	// In production, use environment variable for JWT key
-	jwtKey = getJWTKey()
+	errMissingAuth  = errors.New("Authorization header required")
+	errAuthFormat   = errors.New("Authorization header format must be Bearer <token>")
+	errInvalidToken = errors.New("Invalid or expired token")
+	errInvalidCSRF  = errors.New("Missing or invalid CSRF token")
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// withClaims stores the verified token claims in the request context
+func withClaims(r *http.Request, claims *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims))
+}
 
+// requestUsername returns the username of the authenticated admin, if any
+func requestUsername(r *http.Request) string {
+	if claims, ok := r.Context().Value(claimsContextKey).(*Claims); ok {
+		return claims.Username
+	}
+	return ""
+}
+
+var (
 	adminUsername = "admin"
 	// In a real app, store hashed password and retrieve from a secure storage
 	adminPasswordHash = mustHashPassword("admin") // Default password, should be changed after first login
 )
 
-func getJWTKey() []byte {
-	key := os.Getenv("JWT_SECRET")
-	if key == "" {
-		return []byte("default-secret-key-change-in-production")
-	}
-	return []byte(key)
-}
-
 func mustHashPassword(password string) string {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -48,27 +69,39 @@ func mustHashPassword(password string) string {
 	return string(hash)
 }
 
-func authenticateUser(creds Credentials) (string, error) {
+func checkPassword(creds Credentials) error {
 	// In a real app, verify against a database
 	if creds.Username != adminUsername {
-		return "", errors.New("invalid credentials")
+		return errors.New("invalid credentials")
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(adminPasswordHash), []byte(creds.Password)); err != nil {
-		return "", errors.New("invalid credentials")
+		return errors.New("invalid credentials")
 	}
 
-	// Create JWT token
-	expirationTime := time.Now().Add(24 * time.Hour)
+	return nil
+}
+
+// issueToken creates the full session JWT for an authenticated user.
+// csrf is empty for bearer tokens.
+func issueToken(username, csrf string) (string, error) {
+	expirationTime := time.Now().Add(sessionLifetime)
 	claims := &Claims{
-		Username: creds.Username,
+		Username: username,
+		CSRF:     csrf,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
+	kid, key, err := jwtKeys.signingKey()
+	if err != nil {
+		return "", err
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	token.Header["kid"] = kid
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
@@ -76,13 +109,15 @@ func authenticateUser(creds Credentials) (string, error) {
 	return tokenString, nil
 }
 
-func verifyToken(tokenString string) (*Claims, error) {
+// parseToken checks the signature and expiry of any token issued by this server
+func parseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, jwt.ErrSignatureInvalid
 		}
-		return jwtKey, nil
+		kid, _ := token.Header["kid"].(string)
+		return jwtKeys.verificationKey(kid)
 	})
 
 	if err != nil {
@@ -96,33 +131,79 @@ func verifyToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-// AuthMiddleware verifies the JWT token in the Authorization header
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get token from Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, `{"error":"Authorization header required"}`, http.StatusUnauthorized)
-			return
-		}
+// verifyToken accepts only full session tokens
+func verifyToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("token is not a session token")
+	}
+	return claims, nil
+}
 
-		// Format: Bearer <token>
-		tokenString := ""
-		if len(authHeader) > 7 && strings.ToUpper(authHeader[0:7]) == "BEARER " {
-			tokenString = authHeader[7:]
-		} else {
-			http.Error(w, `{"error":"Authorization header format must be Bearer <token>"}`, http.StatusUnauthorized)
-			return
+// authenticateRequest verifies the bearer token from the Authorization header,
+// or the session cookie when no header is sent. Cookie sessions must pass the
+// CSRF check on mutating requests.
+func authenticateRequest(r *http.Request) (*Claims, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		claims, err := sessionCookieClaims(r)
+		if err != nil {
+			return nil, err
 		}
+		if isMutatingMethod(r.Method) && !checkCSRF(r, claims) {
+			return nil, errInvalidCSRF
+		}
+		return claims, nil
+	}
 
-		_, err := verifyToken(tokenString)
+	// Format: Bearer <token>
+	if len(authHeader) <= 7 || strings.ToUpper(authHeader[0:7]) != "BEARER " {
+		return nil, errAuthFormat
+	}
+
+	claims, err := verifyToken(authHeader[7:])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// sessionCookieClaims verifies the session cookie without the CSRF check. It
+// only identifies the admin and must not authorize changes.
+func sessionCookieClaims(r *http.Request) (*Claims, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, errMissingAuth
+	}
+	claims, err := verifyToken(cookie.Value)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// authErrorStatus maps an authenticateRequest error to the HTTP status
+func authErrorStatus(err error) int {
+	if err == errInvalidCSRF {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// AuthMiddleware verifies the JWT token in the Authorization header or session cookie
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := authenticateRequest(r)
 		if err != nil {
-			http.Error(w, `{"error":"Invalid or expired token`+err.Error()+`"}`, http.StatusUnauthorized)
+			http.Error(w, `{"error":"`+err.Error()+`"}`, authErrorStatus(err))
 			return
 		}
 
 		// Token is valid, proceed with the request
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withClaims(r, claims))
 	})
 }
 
@@ -139,14 +220,48 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := authenticateUser(creds)
-	if err != nil {
+	ip := clientIP(r)
+	now := time.Now()
+
+	// Reject the attempt while the IP or username is delayed or locked out
+	if wait := loginLimiter.retryAfter(ip, creds.Username, now); wait > 0 {
+		writeLoginAudit(LoginAuditEntry{Time: now, Username: creds.Username, IP: ip, Event: "login_blocked", Reason: "rate limited"})
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	if err := checkPassword(creds); err != nil {
+		reason := "invalid credentials"
+		if loginLimiter.recordFailure(ip, creds.Username, now) {
+			reason = "invalid credentials, locked out"
+			log.Printf("Login locked out for user %q from %s", creds.Username, ip)
+		}
+		writeLoginAudit(LoginAuditEntry{Time: now, Username: creds.Username, IP: ip, Event: "login_failed", Reason: reason})
 		http.Error(w, `{"error":"Invalid credentials"}`, http.StatusUnauthorized)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": token,
-	})
+	// With two-factor authentication enabled only an intermediate token is
+	// issued; the session token follows after /api/login/verify
+	if totpEnabled(creds.Username) {
+		mfaToken, err := issueMFAToken(creds.Username)
+		if err != nil {
+			log.Printf("Error issuing MFA token: %v", err)
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		writeLoginAudit(LoginAuditEntry{Time: now, Username: creds.Username, IP: ip, Event: "password_ok", Reason: "second factor required"})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		})
+		return
+	}
+
+	loginLimiter.recordSuccess(ip, creds.Username)
+	writeLoginAudit(LoginAuditEntry{Time: now, Username: creds.Username, IP: ip, Event: "login_success"})
+
+	writeSessionResponse(w, r, creds.Username, creds.Mode)
 }
@@ -2,16 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
-	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Initialize banner data
@@ -54,10 +57,54 @@ func ensureDirs() error {
 }
 
 type BannerContent struct {
+	ID    string      `json:"ID,omitempty"`
 	Text  string      `json:"Text"`
 	Image string      `json:"Image,omitempty"`
 	Link  string      `json:"Link,omitempty"`
 	Style BannerStyle `json:"Style"`
+	// Schedule window, open-ended when nil. Only used by banners in the
+	// collection; the default banner is always active.
+	ValidFrom  *time.Time `json:"ValidFrom,omitempty"`
+	ValidUntil *time.Time `json:"ValidUntil,omitempty"`
+	// Ordering and presentation of concurrent banners
+	Priority    int    `json:"Priority"`              // higher first
+	Severity    string `json:"Severity,omitempty"`    // info, warning, critical
+	Placement   string `json:"Placement,omitempty"`   // top, sidebar
+	Dismissible bool   `json:"Dismissible,omitempty"` // visitors may hide it
+	// Visitors the banner is shown to, everyone when nil
+	Audience *BannerAudience `json:"Audience,omitempty"`
+	// srcset values for the image, filled in responses only
+	ImageSrcset     string `json:"ImageSrcset,omitempty"`
+	ImageWebPSrcset string `json:"ImageWebPSrcset,omitempty"`
+}
+
+// withImageSrcset returns a copy of b with the srcset of its image variants
+func (b BannerContent) withImageSrcset() BannerContent {
+	variants := imageVariants(b.Image)
+	b.ImageSrcset = imageSrcset(variants, mime.TypeByExtension(filepath.Ext(b.Image)))
+	b.ImageWebPSrcset = imageSrcset(variants, "image/webp")
+	return b
+}
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+
+	PlacementTop     = "top"
+	PlacementSidebar = "sidebar"
+)
+
+// severityRank orders severities for sorting, critical first
+var severityRank = map[string]int{
+	SeverityInfo:     0,
+	SeverityWarning:  1,
+	SeverityCritical: 2,
+}
+
+var bannerPlacements = map[string]bool{
+	PlacementTop:     true,
+	PlacementSidebar: true,
 }
 
 type BannerStyle struct {
@@ -154,13 +201,52 @@ func saveBannerData() error {
 	return nil
 }
 
+// bannerResponse keeps the legacy single-banner fields at the top level for
+// old clients and lists all active banners in Banners
+type bannerResponse struct {
+	BannerContent
+	Banners []BannerContent `json:"Banners"`
+}
+
+// GetBannerHandler returns the active banners ordered by priority, optionally
+// filtered by ?placement=. The top-level fields hold the first banner of the
+// requested placement (top by default), which is what old clients render.
 func GetBannerHandler(w http.ResponseWriter, r *http.Request) {
-	bannerLock.RLock()
-	defer bannerLock.RUnlock()
+	// Signed preview links show the unpublished draft instead
+	if r.URL.Query().Get("preview") != "" {
+		preview, err := previewBanner(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		preview = preview.withImageSrcset()
+		json.NewEncoder(w).Encode(bannerResponse{BannerContent: preview, Banners: []BannerContent{preview}})
+		return
+	}
+
+	now := time.Now()
+	placement := r.URL.Query().Get("placement")
+	viewer := viewerFromRequest(r)
+	active := activeBanners(now, placement, viewer)
+
+	for i := range active {
+		active[i] = active[i].withImageSrcset()
+	}
+
+	response := bannerResponse{Banners: active}
+	legacy := active
+	if placement == "" {
+		legacy = activeBanners(now, PlacementTop, viewer)
+	}
+	if len(legacy) > 0 {
+		response.BannerContent = legacy[0].withImageSrcset()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(banner)
+	json.NewEncoder(w).Encode(response)
 }
 
 func UpdateBannerHandler(w http.ResponseWriter, r *http.Request) {
@@ -181,16 +267,60 @@ func UpdateBannerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
+	// Hold off media deletions until the referenced image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	bannerLock.RLock()
+	currentImage := banner.Image
+	bannerLock.RUnlock()
+
+	newBanner, ok := bannerFromForm(w, r, currentImage)
+	if !ok {
+		return
+	}
+
+	// The default banner is the fallback and is never scheduled
+	newBanner.ValidFrom = nil
+	newBanner.ValidUntil = nil
+
+	// Update banner data
+	bannerLock.Lock()
+	previousBanner := banner
+	banner = newBanner
+	bannerLock.Unlock()
+
+	// Save banner data
+	if err := saveBannerData(); err != nil {
+		log.Printf("Error saving banner data: %v", err)
+		http.Error(w, "Error saving banner data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := recordBannerVersion(auditActor(r), defaultBannerID, newBanner, 0); err != nil {
+		log.Printf("Error recording banner version: %v", err)
+		http.Error(w, "Error saving banner history", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Banner updated successfully with image: %s", newBanner.Image)
+	writeAudit(r, "update", "banner", "", previousBanner, newBanner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(banner)
+}
+
+// bannerFromForm builds a banner from the multipart form of the request,
+// storing an uploaded image. currentImage is kept when no new image is sent.
+// On failure the error response has already been written.
+func bannerFromForm(w http.ResponseWriter, r *http.Request, currentImage string) (BannerContent, bool) {
 	// Parse multipart form for file uploads
 	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB max
 		log.Printf("Error parsing form data: %v", err)
 		http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
-		return
+		return BannerContent{}, false
 	}
 
-	// Log form values for debugging
-	log.Printf("Form values: %+v", r.Form)
-
 	// Helper function to get form value with case-insensitive key matching
 	getFormValue := func(keys ...string) string {
 		for _, key := range keys {
@@ -223,8 +353,11 @@ func UpdateBannerHandler(w http.ResponseWriter, r *http.Request) {
 			ImagePosition: getFormValue("Style[ImagePosition]", "style[imageposition]", "right"),
 			ImageX:        parseIntOrDefault(getFormValue("Style[ImageX]", "style[imagex]"), 0),
 			ImageY:        parseIntOrDefault(getFormValue("Style[ImageY]", "style[imagey]"), 0),
+			ImageWidth:    parseIntOrDefault(getFormValue("Style[ImageWidth]", "style[imageWidth]", "style[imagewidth]"), 0),
+			ImageHeight:   parseIntOrDefault(getFormValue("Style[ImageHeight]", "style[imageHeight]", "style[imageheight]"), 0),
 			// Additional style fields
 			Background:     getFormValue("Style[Background]", "style[background]"),
+			ContainerStyle: getFormValue("Style[ContainerStyle]", "style[containerstyle]"),
 		},
 	}
 
@@ -240,117 +373,133 @@ func UpdateBannerHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Log the final banner data for debugging
-	log.Printf("Final banner data: %+v", newBanner)
+	// Problems of every invalid field, reported together
+	problems := make(map[string]string)
+
+	// Optional schedule window
+	for name, target := range map[string]**time.Time{"ValidFrom": &newBanner.ValidFrom, "ValidUntil": &newBanner.ValidUntil} {
+		if value := getFormValue(name); value != "" {
+			t, err := parseBannerTime(value)
+			if err != nil {
+				problems[name] = "must be RFC 3339 or YYYY-MM-DDTHH:MM"
+				continue
+			}
+			*target = &t
+		}
+	}
+	if newBanner.ValidFrom != nil && newBanner.ValidUntil != nil && !newBanner.ValidUntil.After(*newBanner.ValidFrom) {
+		problems["ValidUntil"] = "must be after ValidFrom"
+	}
+
+	// Ordering and placement
+	newBanner.Priority = parseIntOrDefault(getFormValue("Priority"), 0)
+	newBanner.Severity = strings.ToLower(getFormValue("Severity"))
+	if newBanner.Severity == "" {
+		newBanner.Severity = SeverityInfo
+	} else if _, ok := severityRank[newBanner.Severity]; !ok {
+		problems["Severity"] = "must be info, warning or critical"
+	}
+	newBanner.Placement = strings.ToLower(getFormValue("Placement"))
+	if newBanner.Placement == "" {
+		newBanner.Placement = PlacementTop
+	} else if !bannerPlacements[newBanner.Placement] {
+		problems["Placement"] = "must be top or sidebar"
+	}
+	newBanner.Dismissible = getFormValue("Dismissible") == "true"
+
+	// Targeting rules
+	audience, err := audienceFromForm(r)
+	if err != nil {
+		problems["Audience.Networks"] = err.Error()
+	}
+	newBanner.Audience = audience
+
+	// Reject unsafe styles and links, reduce the text to the allowed HTML subset
+	for field, problem := range validateBanner(newBanner) {
+		problems[field] = problem
+	}
+	if len(problems) > 0 {
+		writeValidationErrors(w, problems)
+		return BannerContent{}, false
+	}
+	newBanner.Text = sanitizeBannerHTML(newBanner.Text)
 
 	// Handle file upload
-	file, handler, err := r.FormFile("image")
+	file, _, err := r.FormFile("image")
 	if err == nil {
 		log.Println("Processing file upload...")
 		defer file.Close()
 
-		// Ensure uploads directory exists
-		if err := ensureDirs(); err != nil {
-			log.Printf("Error ensuring directories exist: %v", err)
-			http.Error(w, "Error preparing upload directory", http.StatusInternalServerError)
-			return
-		}
-
-		// Get the file extension
-		ext := filepath.Ext(handler.Filename)
-		if ext == "" {
-			ext = ".jpg" // Default extension if none provided
-		}
-
-		// Create a new file in the uploads directory with a unique name
-		tempFile, err := ioutil.TempFile(uploadDir, "banner-*"+ext)
+		relPath, err := saveUploadedImage(file, "banner", newBanner.Style.ImageWidth, newBanner.Style.ImageHeight)
 		if err != nil {
-			log.Printf("Error creating temp file: %v", err)
-			http.Error(w, "Error creating file", http.StatusInternalServerError)
-			return
-		}
-		defer tempFile.Close()
-
-		// Copy the uploaded file to the destination file
-		if _, err := io.Copy(tempFile, file); err != nil {
-			log.Printf("Error saving file: %v", err)
-			http.Error(w, "Error saving file", http.StatusInternalServerError)
-			return
+			log.Printf("Error saving banner image: %v", err)
+			if errors.Is(err, errInvalidImage) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, "Error saving file", http.StatusInternalServerError)
+			}
+			return BannerContent{}, false
 		}
 
-		// Get the relative path for the web
-		relPath := "/uploads/" + filepath.Base(tempFile.Name())
 		log.Printf("File uploaded successfully: %s", relPath)
+		recordMediaUpload(relPath, auditActor(r), nil)
 		newBanner.Image = relPath
+	} else if existing := r.FormValue("existingImage"); existing != "" {
+		// Image picked from the media library
+		path, err := mediaPath(existing)
+		if err != nil {
+			http.Error(w, "Invalid existingImage: "+err.Error(), http.StatusBadRequest)
+			return BannerContent{}, false
+		}
+		newBanner.Image = "/uploads/" + filepath.Base(path)
 	} else if r.FormValue("removeImage") == "true" {
 		// If removeImage is set, clear the image
 		log.Println("Removing banner image")
 		newBanner.Image = ""
 	} else {
 		// Keep the existing image if no new one is uploaded
-		bannerLock.RLock()
-		newBanner.Image = banner.Image
-		bannerLock.RUnlock()
+		newBanner.Image = currentImage
 		log.Printf("Keeping existing image: %s", newBanner.Image)
 	}
 
-	// Update banner data
-	bannerLock.Lock()
-	banner = newBanner
-	bannerLock.Unlock()
-
-	// Save banner data
-	err = saveBannerData()
-	if err != nil {
-		log.Printf("Error saving banner data: %v", err)
-		http.Error(w, "Error saving banner data: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("Banner updated successfully with image: %s", newBanner.Image)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(banner)
+	return newBanner, true
 }
 
-// ServeUploads handles serving uploaded files
+// ServeUploads handles serving uploaded files. Content-hashed images never
+// change and are cached for a year; other files for a day. Conditional
+// requests are answered via ETag and Last-Modified.
 func ServeUploads(w http.ResponseWriter, r *http.Request) {
 	// Clean the path to prevent directory traversal
-	path := filepath.Clean(r.URL.Path)
-
-	// Only serve files from the uploads directory
-	if !strings.HasPrefix(path, "/uploads/") {
-		log.Printf("Access denied: %s is outside uploads directory", path)
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/uploads/")
+	if !mediaNamePattern.MatchString(name) {
 		http.NotFound(w, r)
 		return
 	}
 
-	// Remove the /uploads/ prefix to get the actual file path
-	filename := filepath.Join(uploadDir, strings.TrimPrefix(path, "/uploads/"))
+	f, err := os.Open(filepath.Join(uploadDir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
 
-	// Ensure the file exists and is within the uploads directory
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		log.Printf("File not found: %s", filename)
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
 		http.NotFound(w, r)
 		return
 	}
 
-	// Set cache control headers (cache for 1 day)
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	// Set content type based on file extension
-	ext := filepath.Ext(filename)
-	if ext == ".jpg" || ext == ".jpeg" {
-		w.Header().Set("Content-Type", "image/jpeg")
-	} else if ext == ".png" {
-		w.Header().Set("Content-Type", "image/png")
-	} else if ext == ".gif" {
-		w.Header().Set("Content-Type", "image/gif")
-	} else if ext == ".svg" {
-		w.Header().Set("Content-Type", "image/svg+xml")
+	if hashedUploadPattern.MatchString(name) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", `"`+strings.TrimSuffix(name, filepath.Ext(name))+`"`)
 	} else {
-		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
 	}
+	// Older uploads may still include SVGs; never let them run scripts
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
 
-	http.ServeFile(w, r, filename)
-	log.Printf("Served file: %s", filename)
+	// The content type is derived from the extension
+	http.ServeContent(w, r, name, info.ModTime(), f)
 }
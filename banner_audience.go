@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userGroupsFile = "data/user_groups.json"
+
+	// Cookie and query parameter naming the visitor's department
+	departmentCookieName = "department"
+	departmentParam      = "department"
+)
+
+// BannerAudience restricts a banner to some visitors. A visitor sees the
+// banner when any of the rules matches; an empty audience means everyone.
+type BannerAudience struct {
+	Networks    []string `json:"Networks,omitempty"`    // client IP subnets in CIDR notation
+	Departments []string `json:"Departments,omitempty"` // department cookie or query parameter
+	Groups      []string `json:"Groups,omitempty"`      // groups of the logged in admin user
+
+	// Networks parsed once when the banner is loaded or created
+	networks []*net.IPNet
+}
+
+// UnmarshalJSON loads the audience and parses its networks
+func (a *BannerAudience) UnmarshalJSON(data []byte) error {
+	type plain BannerAudience
+	if err := json.Unmarshal(data, (*plain)(a)); err != nil {
+		return err
+	}
+	a.parseNetworks()
+	return nil
+}
+
+// parseNetworks fills networks from Networks, skipping invalid entries
+func (a *BannerAudience) parseNetworks() {
+	a.networks = nil
+	for _, cidr := range a.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Ignoring invalid banner audience network %q", cidr)
+			continue
+		}
+		a.networks = append(a.networks, network)
+	}
+}
+
+func (a *BannerAudience) isEmpty() bool {
+	return a == nil || len(a.Networks) == 0 && len(a.Departments) == 0 && len(a.Groups) == 0
+}
+
+// bannerViewer is who a banner response is rendered for
+type bannerViewer struct {
+	IP         net.IP
+	Department string
+	Groups     []string
+}
+
+// matches reports whether the viewer belongs to the audience
+func (a *BannerAudience) matches(v *bannerViewer) bool {
+	if a.isEmpty() || v == nil {
+		return true
+	}
+	if containsIP(a.networks, v.IP) {
+		return true
+	}
+	for _, department := range a.Departments {
+		if v.Department != "" && strings.EqualFold(department, v.Department) {
+			return true
+		}
+	}
+	for _, group := range a.Groups {
+		for _, g := range v.Groups {
+			if strings.EqualFold(group, g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// viewerFromRequest describes the visitor of a public banner request. The
+// department comes from ?department= or the department cookie; groups only
+// apply to requests carrying a valid admin session.
+func viewerFromRequest(r *http.Request) *bannerViewer {
+	v := &bannerViewer{IP: net.ParseIP(clientIP(r))}
+
+	if department := r.URL.Query().Get(departmentParam); department != "" {
+		v.Department = department
+	} else if c, err := r.Cookie(departmentCookieName); err == nil {
+		v.Department = c.Value
+	}
+
+	if claims, err := authenticateRequest(r); err == nil {
+		v.Groups = userGroups(claims.Username)
+	}
+	return v
+}
+
+// userGroupsCache holds data/user_groups.json, reloaded when the file's
+// modification time changes
+var userGroupsCache struct {
+	sync.Mutex
+	modTime time.Time
+	groups  map[string][]string
+}
+
+// userGroups returns the groups of a user from data/user_groups.json, a map
+// of username to group names
+func userGroups(username string) []string {
+	info, err := os.Stat(userGroupsFile)
+	if err != nil {
+		return nil
+	}
+
+	userGroupsCache.Lock()
+	defer userGroupsCache.Unlock()
+	if !info.ModTime().Equal(userGroupsCache.modTime) {
+		var groups map[string][]string
+		data, err := ioutil.ReadFile(userGroupsFile)
+		if err == nil {
+			err = json.Unmarshal(data, &groups)
+		}
+		if err != nil {
+			log.Printf("Error loading user groups: %v", err)
+		}
+		userGroupsCache.modTime = info.ModTime()
+		userGroupsCache.groups = groups
+	}
+	return userGroupsCache.groups[username]
+}
+
+// audienceFromForm reads the comma separated Audience[Networks],
+// Audience[Departments] and Audience[Groups] fields. Single IP addresses are
+// turned into host networks. Returns nil when no rule is set.
+func audienceFromForm(r *http.Request) (*BannerAudience, error) {
+	split := func(key string) []string {
+		var values []string
+		for _, value := range strings.Split(r.FormValue(key), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+
+	audience := &BannerAudience{
+		Departments: split("Audience[Departments]"),
+		Groups:      split("Audience[Groups]"),
+	}
+	for _, network := range split("Audience[Networks]") {
+		cidr, err := normalizeCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		audience.Networks = append(audience.Networks, cidr)
+	}
+
+	if audience.isEmpty() {
+		return nil, nil
+	}
+	audience.parseNetworks()
+	return audience, nil
+}
+
+// normalizeCIDR accepts a CIDR or a single IP address
+func normalizeCIDR(value string) (string, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", fmt.Errorf("invalid network %q", value)
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid network %q", value)
+	}
+	return network.String(), nil
+}
+
+// PreviewBannerAudienceHandler shows the banners a given audience would get
+// from GET /api/banner. Query parameters: ip, department, groups (comma
+// separated), placement and at (RFC 3339, defaults to now).
+func PreviewBannerAudienceHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	viewer := &bannerViewer{Department: q.Get("department")}
+
+	if ip := q.Get("ip"); ip != "" {
+		if viewer.IP = net.ParseIP(ip); viewer.IP == nil {
+			http.Error(w, `{"error":"Invalid ip parameter"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, group := range strings.Split(q.Get("groups"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			viewer.Groups = append(viewer.Groups, group)
+		}
+	}
+
+	at := time.Now()
+	if value := q.Get("at"); value != "" {
+		t, err := parseBannerTime(value)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid at parameter"}`, http.StatusBadRequest)
+			return
+		}
+		at = t
+	}
+
+	active := activeBanners(at, q.Get("placement"), viewer)
+	for i := range active {
+		active[i] = active[i].withImageSrcset()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"audience": viewer,
+		"at":       at,
+		"banners":  active,
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	bannerDraftFile = "data/banner_draft.json"
+
+	bannerPreviewPurpose  = "banner_preview"
+	bannerPreviewLifetime = 1 * time.Hour
+)
+
+// BannerDraft is an unpublished edit of the default banner
+type BannerDraft struct {
+	Author    string        `json:"Author"`
+	UpdatedAt time.Time     `json:"UpdatedAt"`
+	Banner    BannerContent `json:"Banner"`
+}
+
+// Guarded by bannerLock together with the published banner
+var bannerDraft *BannerDraft
+
+func init() {
+	if data, err := ioutil.ReadFile(bannerDraftFile); err == nil {
+		var draft BannerDraft
+		if err := json.Unmarshal(data, &draft); err != nil {
+			log.Printf("Error loading banner draft: %v", err)
+		} else {
+			bannerDraft = &draft
+		}
+	}
+}
+
+// saveBannerDraft writes the draft, or removes the file when there is none.
+// Callers must hold bannerLock.
+func saveBannerDraft() error {
+	if bannerDraft == nil {
+		if err := os.Remove(bannerDraftFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove banner draft: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(bannerDraftFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	data, err := json.MarshalIndent(bannerDraft, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal banner draft: %w", err)
+	}
+	if err := ioutil.WriteFile(bannerDraftFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write banner draft: %w", err)
+	}
+	return nil
+}
+
+// currentBannerDraft returns a copy of the draft, if any
+func currentBannerDraft() (BannerDraft, bool) {
+	bannerLock.RLock()
+	defer bannerLock.RUnlock()
+
+	if bannerDraft == nil {
+		return BannerDraft{}, false
+	}
+	return *bannerDraft, true
+}
+
+// issueBannerPreviewToken signs a token that lets index.html show the draft
+func issueBannerPreviewToken(username string) (string, time.Time, error) {
+	kid, key, err := jwtKeys.signingKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(bannerPreviewLifetime)
+	claims := &Claims{
+		Username: username,
+		Purpose:  bannerPreviewPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	return signed, expires, err
+}
+
+// previewBanner returns the draft when the request carries a valid preview token
+func previewBanner(r *http.Request) (BannerContent, error) {
+	claims, err := parseToken(r.URL.Query().Get("preview"))
+	if err != nil || claims.Purpose != bannerPreviewPurpose {
+		return BannerContent{}, errors.New("invalid or expired preview link")
+	}
+
+	draft, ok := currentBannerDraft()
+	if !ok {
+		return BannerContent{}, errors.New("no banner draft")
+	}
+	preview := draft.Banner
+	preview.ID = "draft"
+	return preview, nil
+}
+
+// GetBannerDraftHandler returns the current draft
+func GetBannerDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draft, ok := currentBannerDraft()
+	if !ok {
+		http.Error(w, "No banner draft", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+// SaveBannerDraftHandler stores the submitted banner as a draft without publishing it
+func SaveBannerDraftHandler(w http.ResponseWriter, r *http.Request) {
+	// Hold off media deletions until the referenced image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	// A new image replaces the draft's image, or the published one for a fresh draft
+	bannerLock.RLock()
+	currentImage := banner.Image
+	if bannerDraft != nil {
+		currentImage = bannerDraft.Banner.Image
+	}
+	bannerLock.RUnlock()
+
+	newBanner, ok := bannerFromForm(w, r, currentImage)
+	if !ok {
+		return
+	}
+	newBanner.ValidFrom = nil
+	newBanner.ValidUntil = nil
+
+	draft := BannerDraft{
+		Author:    auditActor(r),
+		UpdatedAt: time.Now(),
+		Banner:    newBanner,
+	}
+
+	bannerLock.Lock()
+	var previous interface{}
+	if bannerDraft != nil {
+		previous = bannerDraft.Banner
+	}
+	bannerDraft = &draft
+	err := saveBannerDraft()
+	bannerLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving banner draft: %v", err)
+		http.Error(w, "Error saving banner draft: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAudit(r, "save_draft", "banner", "", previous, newBanner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+// BannerPreviewURLHandler returns a signed link to the homepage showing the draft
+func BannerPreviewURLHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := currentBannerDraft(); !ok {
+		http.Error(w, "No banner draft", http.StatusNotFound)
+		return
+	}
+
+	token, expires, err := issueBannerPreviewToken(auditActor(r))
+	if err != nil {
+		log.Printf("Error issuing preview token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        "/?preview=" + url.QueryEscape(token),
+		"expires_at": expires,
+	})
+}
+
+// PublishBannerDraftHandler makes the draft the live default banner
+func PublishBannerDraftHandler(w http.ResponseWriter, r *http.Request) {
+	bannerLock.Lock()
+	if bannerDraft == nil {
+		bannerLock.Unlock()
+		http.Error(w, "No banner draft", http.StatusNotFound)
+		return
+	}
+	draft := bannerDraft
+	previousBanner := banner
+	published := draft.Banner
+	banner = published
+	bannerLock.Unlock()
+
+	// The draft is only removed once the banner is saved, so a failed
+	// publish can be retried
+	if err := saveBannerData(); err != nil {
+		bannerLock.Lock()
+		banner = previousBanner
+		bannerLock.Unlock()
+		log.Printf("Error saving banner data: %v", err)
+		http.Error(w, "Error saving banner data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bannerLock.Lock()
+	// Keep a draft saved again while publishing
+	if bannerDraft == draft {
+		bannerDraft = nil
+	}
+	err := saveBannerDraft()
+	bannerLock.Unlock()
+	if err != nil {
+		log.Printf("Error removing banner draft: %v", err)
+	}
+
+	if _, err := recordBannerVersion(auditActor(r), defaultBannerID, published, 0); err != nil {
+		log.Printf("Error recording banner version: %v", err)
+		http.Error(w, "Error saving banner history", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Banner draft published")
+	writeAudit(r, "publish", "banner", "", previousBanner, published)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(published)
+}
+
+// DiscardBannerDraftHandler deletes the draft
+func DiscardBannerDraftHandler(w http.ResponseWriter, r *http.Request) {
+	bannerLock.Lock()
+	if bannerDraft == nil {
+		bannerLock.Unlock()
+		http.Error(w, "No banner draft", http.StatusNotFound)
+		return
+	}
+	discarded := bannerDraft.Banner
+	bannerDraft = nil
+	err := saveBannerDraft()
+	bannerLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error removing banner draft: %v", err)
+		http.Error(w, "Error removing banner draft", http.StatusInternalServerError)
+		return
+	}
+
+	writeAudit(r, "discard_draft", "banner", "", discarded, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const bannerHistoryFile = "data/banner_history.json"
+
+// BannerVersion is a saved state of the default banner or of a banner of the
+// collection. Deleted marks the version recording the removal of a collection
+// banner; Banner then holds its last state.
+type BannerVersion struct {
+	Version        int           `json:"Version"`
+	BannerID       string        `json:"BannerID"`
+	Deleted        bool          `json:"Deleted,omitempty"`
+	Author         string        `json:"Author"`
+	CreatedAt      time.Time     `json:"CreatedAt"`
+	RolledBackFrom int           `json:"RolledBackFrom,omitempty"`
+	Banner         BannerContent `json:"Banner"`
+}
+
+// bannerVersionView is a version in the history listing together with the
+// BannerStyle fields changed compared to the previous version
+type bannerVersionView struct {
+	BannerVersion
+	StyleChanges []AuditChange `json:"StyleChanges"`
+}
+
+var (
+	bannerHistory     []BannerVersion
+	bannerHistoryLock sync.Mutex
+)
+
+func init() {
+	if data, err := ioutil.ReadFile(bannerHistoryFile); err == nil {
+		if err := json.Unmarshal(data, &bannerHistory); err != nil {
+			log.Printf("Error loading banner history: %v", err)
+		}
+	}
+	// Versions saved before the collection was versioned belong to the default banner
+	for i := range bannerHistory {
+		if bannerHistory[i].BannerID == "" {
+			bannerHistory[i].BannerID = defaultBannerID
+		}
+	}
+
+	// Seed the history with the banner loaded at startup
+	if len(bannerHistory) == 0 {
+		bannerLock.RLock()
+		current := banner
+		bannerLock.RUnlock()
+		if _, err := recordBannerVersion("system", defaultBannerID, current, 0); err != nil {
+			log.Printf("Error recording initial banner version: %v", err)
+		}
+	}
+}
+
+// recordBannerVersion appends a new version of the banner with the given ID
+// (defaultBannerID for the default banner) and saves the history
+func recordBannerVersion(author, bannerID string, b BannerContent, rolledBackFrom int) (BannerVersion, error) {
+	return appendBannerVersion(BannerVersion{
+		BannerID:       bannerID,
+		Author:         author,
+		RolledBackFrom: rolledBackFrom,
+		Banner:         b,
+	})
+}
+
+// recordBannerDeletion appends a version recording that a collection banner
+// was deleted, so it can be restored by rolling back to an earlier version
+func recordBannerDeletion(author string, b BannerContent) (BannerVersion, error) {
+	return appendBannerVersion(BannerVersion{
+		BannerID: b.ID,
+		Deleted:  true,
+		Author:   author,
+		Banner:   b,
+	})
+}
+
+// appendBannerVersion numbers and timestamps the version, appends it and
+// saves the history. Version numbers are shared by all banners. The version is
+// only kept when the history could be saved.
+func appendBannerVersion(version BannerVersion) (BannerVersion, error) {
+	bannerHistoryLock.Lock()
+	defer bannerHistoryLock.Unlock()
+
+	version.Version = 1
+	if len(bannerHistory) > 0 {
+		version.Version = bannerHistory[len(bannerHistory)-1].Version + 1
+	}
+	version.CreatedAt = time.Now()
+	history := append(bannerHistory[:len(bannerHistory):len(bannerHistory)], version)
+
+	if err := os.MkdirAll(filepath.Dir(bannerHistoryFile), 0755); err != nil {
+		return version, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return version, fmt.Errorf("failed to marshal banner history: %w", err)
+	}
+	if err := ioutil.WriteFile(bannerHistoryFile, data, 0644); err != nil {
+		return version, fmt.Errorf("failed to write banner history: %w", err)
+	}
+	bannerHistory = history
+	return version, nil
+}
+
+// findBannerVersion returns the version with the given number
+func findBannerVersion(number int) (BannerVersion, bool) {
+	bannerHistoryLock.Lock()
+	defer bannerHistoryLock.Unlock()
+
+	for _, v := range bannerHistory {
+		if v.Version == number {
+			return v, true
+		}
+	}
+	return BannerVersion{}, false
+}
+
+// styleDiff lists the BannerStyle fields that differ between two banners
+func styleDiff(before, after BannerContent) []AuditChange {
+	_, beforeFields := auditSnapshot(before.Style)
+	_, afterFields := auditSnapshot(after.Style)
+	changes := diffFields(beforeFields, afterFields)
+	if changes == nil {
+		changes = []AuditChange{}
+	}
+	return changes
+}
+
+// GetBannerHistoryHandler lists the versions of one banner (?banner=, the
+// default banner when omitted), newest first, each with its style changes
+// against the previous version of that banner
+func GetBannerHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	bannerID := r.URL.Query().Get("banner")
+	if bannerID == "" {
+		bannerID = defaultBannerID
+	}
+
+	bannerHistoryLock.Lock()
+	history := []BannerVersion{}
+	for _, v := range bannerHistory {
+		if v.BannerID == bannerID {
+			history = append(history, v)
+		}
+	}
+	bannerHistoryLock.Unlock()
+
+	views := make([]bannerVersionView, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		view := bannerVersionView{BannerVersion: history[i], StyleChanges: []AuditChange{}}
+		if i > 0 {
+			view.StyleChanges = styleDiff(history[i-1].Banner, history[i].Banner)
+		}
+		views = append(views, view)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// GetBannerDiffHandler compares the BannerStyle of two versions (?from=&to=).
+// to defaults to the latest version of the banner from belongs to.
+func GetBannerDiffHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid from version", http.StatusBadRequest)
+		return
+	}
+
+	fromVersion, ok := findBannerVersion(from)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Version %d not found", from), http.StatusNotFound)
+		return
+	}
+
+	bannerHistoryLock.Lock()
+	latest := from
+	for _, v := range bannerHistory {
+		if v.BannerID == fromVersion.BannerID {
+			latest = v.Version
+		}
+	}
+	bannerHistoryLock.Unlock()
+	to := parseIntOrDefault(r.URL.Query().Get("to"), latest)
+
+	toVersion, ok := findBannerVersion(to)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Version %d not found", to), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":          from,
+		"to":            to,
+		"style_changes": styleDiff(fromVersion.Banner, toVersion.Banner),
+	})
+}
+
+// RollbackBannerHandler restores the banner a previous version belongs to.
+// A deleted collection banner is added again. The restored state is recorded
+// as a new version.
+func RollbackBannerHandler(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	version, ok := findBannerVersion(number)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Version %d not found", number), http.StatusNotFound)
+		return
+	}
+	if version.Deleted {
+		http.Error(w, fmt.Sprintf("Version %d records a deletion; roll back to an earlier version", number), http.StatusBadRequest)
+		return
+	}
+
+	// Hold off media deletions until the restored image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	// Uploads in use cannot be deleted through the API, but may still have
+	// been removed from disk
+	if image := version.Banner.Image; strings.HasPrefix(image, "/uploads/") {
+		if _, err := mediaPath(image); err != nil {
+			http.Error(w, fmt.Sprintf("Image of version %d no longer exists", number), http.StatusConflict)
+			return
+		}
+	}
+
+	var previousBanner interface{}
+	if version.BannerID == defaultBannerID {
+		bannerLock.Lock()
+		previousBanner = banner
+		banner = version.Banner
+		bannerLock.Unlock()
+
+		if err := saveBannerData(); err != nil {
+			log.Printf("Error saving banner data: %v", err)
+			http.Error(w, "Error saving banner data: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		bannerLock.Lock()
+		if index := bannerIndex(version.BannerID); index >= 0 {
+			previousBanner = bannerList[index]
+			bannerList[index] = version.Banner
+		} else {
+			bannerList = append(bannerList, version.Banner)
+		}
+		err := saveBannerList()
+		bannerLock.Unlock()
+
+		if err != nil {
+			log.Printf("Error saving banners: %v", err)
+			http.Error(w, "Error saving banner data", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	restored, err := recordBannerVersion(auditActor(r), version.BannerID, version.Banner, number)
+	if err != nil {
+		log.Printf("Error recording banner version: %v", err)
+		http.Error(w, "Error saving banner history", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Banner rolled back to version %d", number)
+	writeAudit(r, "rollback", "banner", strconv.Itoa(number), previousBanner, version.Banner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restored)
+}
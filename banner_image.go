@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register WebP decoder
+)
+
+const (
+	// Largest accepted upload and decoded image size
+	maxImageUploadBytes = 10 << 20
+	maxImagePixels      = 40 * 1000 * 1000
+
+	// Largest edge of a stored image when no size is configured
+	maxImageEdge = 2000
+
+	// Uploads younger than this are never collected, so a banner form that
+	// is still being saved does not lose its image
+	uploadGCGracePeriod = time.Hour
+	uploadGCInterval    = 6 * time.Hour
+)
+
+// errInvalidImage marks uploads rejected because of their content
+var errInvalidImage = errors.New("invalid image")
+
+// Raster types accepted for uploaded images, by sniffed content type
+var uploadImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// saveUploadedImage verifies an uploaded image and stores a re-encoded copy in
+// the uploads directory under a name starting with prefix, followed by a hash
+// of the content. The type is sniffed from the content, never taken from the
+// file name. Decoding and encoding again drops EXIF and any other metadata.
+// Images larger than width x height are scaled down to fit; zero means no
+// limit for that edge. Smaller variants for srcset are stored next to it.
+// Returns the web path of the stored file.
+func saveUploadedImage(src io.Reader, prefix string, width, height int) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(src, maxImageUploadBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	if len(data) > maxImageUploadBytes {
+		return "", fmt.Errorf("%w: larger than %d MB", errInvalidImage, maxImageUploadBytes>>20)
+	}
+
+	if !uploadImageTypes[http.DetectContentType(data)] {
+		return "", fmt.Errorf("%w: use JPEG, PNG, GIF or WebP", errInvalidImage)
+	}
+
+	// Check the dimensions before allocating the full image
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return "", fmt.Errorf("%w: dimensions %dx%d are not allowed", errInvalidImage, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	if width <= 0 && height <= 0 {
+		width, height = maxImageEdge, maxImageEdge
+	}
+	img = fitImage(img, width, height)
+
+	// JPEGs stay JPEG, everything else becomes PNG to keep transparency
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+
+	encoded, err := encodeImage(img, ext)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	if err := ensureDirs(); err != nil {
+		return "", fmt.Errorf("failed to prepare upload directory: %w", err)
+	}
+	sum := sha256.Sum256(encoded)
+	stem := prefix + "-" + hex.EncodeToString(sum[:8])
+	if err := writeUploadFile(stem+ext, encoded); err != nil {
+		return "", err
+	}
+	storeImageVariants(img, stem, ext)
+
+	return "/uploads/" + stem + ext, nil
+}
+
+// encodeImage encodes img as JPEG or PNG depending on ext
+func encodeImage(img image.Image, ext string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if ext == ".jpg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// writeUploadFile stores data under uploads/name, replacing the file atomically
+func writeUploadFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(uploadDir, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(uploadDir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// fitImage scales img down to fit into width x height keeping its aspect
+// ratio. Images already small enough are returned unchanged.
+func fitImage(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	scale := 1.0
+	if width > 0 && b.Dx() > width {
+		scale = float64(width) / float64(b.Dx())
+	}
+	if height > 0 && b.Dy() > height {
+		if s := float64(height) / float64(b.Dy()); s < scale {
+			scale = s
+		}
+	}
+	if scale >= 1 {
+		return img
+	}
+
+	w := int(float64(b.Dx())*scale + 0.5)
+	h := int(float64(b.Dy())*scale + 0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// collectBannerUploads removes uploads/banner-* files nothing refers to
+// anymore. Versions in the banner history count as references so rollbacks
+// keep their images.
+func collectBannerUploads(now time.Time) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(uploadDir, "banner-*"))
+	if err != nil {
+		return 0, err
+	}
+
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	// Variants live as long as the image they were generated from
+	used := make(map[string]bool)
+	for name := range uploadReferences() {
+		used[uploadStem(name)] = true
+	}
+
+	removed := 0
+	for _, path := range matches {
+		if used[uploadStem(filepath.Base(path))] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || now.Sub(info.ModTime()) < uploadGCGracePeriod {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing unused upload %s: %v", path, err)
+			continue
+		}
+		forgetMedia(filepath.Base(path))
+		forgetImageVariants(filepath.Base(path))
+		removed++
+	}
+	return removed, nil
+}
+
+// startUploadGC collects unused banner uploads now and every uploadGCInterval
+func startUploadGC() {
+	go func() {
+		for {
+			removed, err := collectBannerUploads(time.Now())
+			if err != nil {
+				log.Printf("Error collecting unused uploads: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d unused banner uploads", removed)
+			}
+			time.Sleep(uploadGCInterval)
+		}
+	}()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	bannerStatsFile = "data/banner_stats.json"
+
+	// Counters are kept in memory and written out at this interval
+	bannerStatsFlushInterval = 30 * time.Second
+)
+
+// BannerDayStats are the counters of one banner on one day
+type BannerDayStats struct {
+	Impressions int `json:"impressions"`
+	Clicks      int `json:"clicks"`
+}
+
+var (
+	// banner ID -> day (YYYY-MM-DD) -> counters
+	bannerStats      = map[string]map[string]*BannerDayStats{}
+	bannerStatsDirty bool
+	bannerStatsLock  sync.Mutex
+)
+
+func init() {
+	if data, err := ioutil.ReadFile(bannerStatsFile); err == nil {
+		if err := json.Unmarshal(data, &bannerStats); err != nil {
+			log.Printf("Error loading banner stats: %v", err)
+		}
+	}
+}
+
+// countBannerEvent increments the impression or click counter of a banner for today
+func countBannerEvent(id string, click bool) {
+	day := time.Now().Format("2006-01-02")
+
+	bannerStatsLock.Lock()
+	defer bannerStatsLock.Unlock()
+
+	days, ok := bannerStats[id]
+	if !ok {
+		days = make(map[string]*BannerDayStats)
+		bannerStats[id] = days
+	}
+	counters, ok := days[day]
+	if !ok {
+		counters = &BannerDayStats{}
+		days[day] = counters
+	}
+	if click {
+		counters.Clicks++
+	} else {
+		counters.Impressions++
+	}
+	bannerStatsDirty = true
+}
+
+// flushBannerStats writes the counters if they changed since the last flush
+func flushBannerStats() error {
+	bannerStatsLock.Lock()
+	defer bannerStatsLock.Unlock()
+
+	if !bannerStatsDirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(bannerStatsFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	data, err := json.MarshalIndent(bannerStats, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal banner stats: %w", err)
+	}
+	if err := ioutil.WriteFile(bannerStatsFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write banner stats: %w", err)
+	}
+	bannerStatsDirty = false
+	return nil
+}
+
+// startBannerStatsFlush writes the counters every bannerStatsFlushInterval
+func startBannerStatsFlush() {
+	go func() {
+		for range time.Tick(bannerStatsFlushInterval) {
+			if err := flushBannerStats(); err != nil {
+				log.Printf("Error saving banner stats: %v", err)
+			}
+		}
+	}()
+}
+
+// findBanner looks up the default banner or a banner from the list by ID
+func findBanner(id string) (BannerContent, bool) {
+	bannerLock.RLock()
+	defer bannerLock.RUnlock()
+
+	if id == defaultBannerID {
+		b := banner
+		b.ID = defaultBannerID
+		return b, true
+	}
+	if i := bannerIndex(id); i >= 0 {
+		return bannerList[i], true
+	}
+	return BannerContent{}, false
+}
+
+// BannerImpressionHandler counts a banner being shown. Sent by the homepage
+// via navigator.sendBeacon, so it answers with an empty 204.
+func BannerImpressionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := findBanner(id); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	countBannerEvent(id, false)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BannerClickHandler counts a click and redirects to the banner's Link. The
+// target is always taken from the stored banner, never from the request.
+func BannerClickHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	b, ok := findBanner(id)
+	if !ok || b.Link == "" {
+		http.NotFound(w, r)
+		return
+	}
+	countBannerEvent(id, true)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, b.Link, http.StatusFound)
+}
+
+// bannerStatsSummary is the per-banner entry of GET /api/banners/stats
+type bannerStatsSummary struct {
+	ID          string                    `json:"id"`
+	Text        string                    `json:"text,omitempty"`
+	Impressions int                       `json:"impressions"`
+	Clicks      int                       `json:"clicks"`
+	CTR         float64                   `json:"ctr"` // clicks per impression
+	Days        map[string]BannerDayStats `json:"days"`
+}
+
+// GetBannerStatsHandler returns impressions and clicks per banner and day.
+// ?from= and ?to= (YYYY-MM-DD, inclusive) limit the days; default is the last 30.
+func GetBannerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now().Format("2006-01-02")
+	from := time.Now().AddDate(0, 0, -29).Format("2006-01-02")
+	for name, target := range map[string]*string{"from": &from, "to": &to} {
+		if value := q.Get(name); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"Invalid %s parameter"}`, name), http.StatusBadRequest)
+				return
+			}
+			*target = value
+		}
+	}
+
+	bannerStatsLock.Lock()
+	summaries := []bannerStatsSummary{}
+	for id, days := range bannerStats {
+		summary := bannerStatsSummary{ID: id, Days: map[string]BannerDayStats{}}
+		for day, counters := range days {
+			if day < from || day > to {
+				continue
+			}
+			summary.Days[day] = *counters
+			summary.Impressions += counters.Impressions
+			summary.Clicks += counters.Clicks
+		}
+		if len(summary.Days) > 0 {
+			summaries = append(summaries, summary)
+		}
+	}
+	bannerStatsLock.Unlock()
+
+	for i := range summaries {
+		if b, ok := findBanner(summaries[i].ID); ok {
+			summaries[i].Text = b.Text
+		}
+		if summaries[i].Impressions > 0 {
+			summaries[i].CTR = float64(summaries[i].Clicks) / float64(summaries[i].Impressions)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Impressions > summaries[j].Impressions })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":    from,
+		"to":      to,
+		"banners": summaries,
+	})
+}
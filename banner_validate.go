@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Maximum lengths of free-form banner fields
+const (
+	maxBannerTextLength  = 5000
+	maxBannerLinkLength  = 2048
+	maxStyleValueLength  = 300
+	maxContainerStyleLen = 1000
+)
+
+var (
+	hexColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+	// rgb()/rgba()/hsl()/hsla() with numeric arguments only
+	colorFuncPattern = regexp.MustCompile(`^(?:rgba?|hsla?)\(\s*[0-9.]+(?:deg|%)?\s*(?:[,\s]\s*[0-9.]+%?\s*){2}(?:[,/]\s*[0-9.]+%?\s*)?\)$`)
+	lengthPattern    = regexp.MustCompile(`^(?:0|-?[0-9]*\.?[0-9]+(?:px|em|rem|%|vh|vw|pt))$`)
+	anglePattern     = regexp.MustCompile(`^-?[0-9]*\.?[0-9]+(?:deg|turn|rad)$`)
+	directionPattern = regexp.MustCompile(`^to (?:top|bottom|left|right)(?: (?:top|bottom|left|right))?$`)
+	radialPattern    = regexp.MustCompile(`^(?:circle|ellipse)?(?: ?(?:closest|farthest)-(?:side|corner))?(?: ?at (?:center|top|bottom|left|right)(?: (?:center|top|bottom|left|right))?)?$`)
+)
+
+// CSS named colors (CSS Color Module Level 4) plus keywords
+var namedColors = map[string]bool{}
+
+func init() {
+	for _, name := range strings.Fields(`transparent currentcolor
+		aliceblue antiquewhite aqua aquamarine azure beige bisque black blanchedalmond blue
+		blueviolet brown burlywood cadetblue chartreuse chocolate coral cornflowerblue cornsilk
+		crimson cyan darkblue darkcyan darkgoldenrod darkgray darkgreen darkgrey darkkhaki
+		darkmagenta darkolivegreen darkorange darkorchid darkred darksalmon darkseagreen
+		darkslateblue darkslategray darkslategrey darkturquoise darkviolet deeppink deepskyblue
+		dimgray dimgrey dodgerblue firebrick floralwhite forestgreen fuchsia gainsboro ghostwhite
+		gold goldenrod gray green greenyellow grey honeydew hotpink indianred indigo ivory khaki
+		lavender lavenderblush lawngreen lemonchiffon lightblue lightcoral lightcyan
+		lightgoldenrodyellow lightgray lightgreen lightgrey lightpink lightsalmon lightseagreen
+		lightskyblue lightslategray lightslategrey lightsteelblue lightyellow lime limegreen linen
+		magenta maroon mediumaquamarine mediumblue mediumorchid mediumpurple mediumseagreen
+		mediumslateblue mediumspringgreen mediumturquoise mediumvioletred midnightblue mintcream
+		mistyrose moccasin navajowhite navy oldlace olive olivedrab orange orangered orchid
+		palegoldenrod palegreen paleturquoise palevioletred papayawhip peachpuff peru pink plum
+		powderblue purple rebeccapurple red rosybrown royalblue saddlebrown salmon sandybrown
+		seagreen seashell sienna silver skyblue slateblue slategray slategrey snow springgreen
+		steelblue tan teal thistle tomato turquoise violet wheat white whitesmoke yellow
+		yellowgreen`) {
+		namedColors[name] = true
+	}
+}
+
+var (
+	textAlignments = map[string]bool{"left": true, "right": true, "center": true, "justify": true}
+	imagePositions = map[string]bool{"left": true, "right": true, "center": true, "custom": true}
+)
+
+// isCSSColor accepts hex, rgb/hsl functions and named colors
+func isCSSColor(value string) bool {
+	value = strings.TrimSpace(value)
+	return hexColorPattern.MatchString(value) ||
+		colorFuncPattern.MatchString(strings.ToLower(value)) ||
+		namedColors[strings.ToLower(value)]
+}
+
+// isCSSGradient accepts linear-gradient() and radial-gradient() with color stops
+func isCSSGradient(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	var args string
+	radial := false
+	switch {
+	case strings.HasPrefix(value, "linear-gradient(") && strings.HasSuffix(value, ")"):
+		args = value[len("linear-gradient(") : len(value)-1]
+	case strings.HasPrefix(value, "radial-gradient(") && strings.HasSuffix(value, ")"):
+		args = value[len("radial-gradient(") : len(value)-1]
+		radial = true
+	default:
+		return false
+	}
+
+	parts := splitTopLevel(args, ',')
+	if len(parts) == 0 {
+		return false
+	}
+
+	// Optional leading angle, direction or shape
+	first := strings.TrimSpace(parts[0])
+	if (!radial && (anglePattern.MatchString(first) || directionPattern.MatchString(first))) ||
+		(radial && first != "" && radialPattern.MatchString(first)) {
+		parts = parts[1:]
+	}
+	if len(parts) < 2 {
+		return false
+	}
+
+	for _, stop := range parts {
+		if !isColorStop(strings.TrimSpace(stop)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isColorStop accepts "<color> [<length>] [<length>]"
+func isColorStop(stop string) bool {
+	tokens := splitTopLevel(stop, ' ')
+	if len(tokens) == 0 || len(tokens) > 3 || !isCSSColor(tokens[0]) {
+		return false
+	}
+	for _, t := range tokens[1:] {
+		if !lengthPattern.MatchString(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCSSBackground accepts a color or a gradient
+func isCSSBackground(value string) bool {
+	return isCSSColor(value) || isCSSGradient(value)
+}
+
+// isCSSLength accepts a single length like 16px or 1.5em
+func isCSSLength(value string) bool {
+	return lengthPattern.MatchString(strings.TrimSpace(value))
+}
+
+// isCSSBoxLengths accepts one to four lengths (padding, margin, border-radius).
+// auto is allowed when allowAuto is set.
+func isCSSBoxLengths(value string, allowAuto bool) bool {
+	parts := strings.Fields(value)
+	if len(parts) == 0 || len(parts) > 4 {
+		return false
+	}
+	for _, p := range parts {
+		if !(lengthPattern.MatchString(p) || (allowAuto && p == "auto")) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTopLevel splits s on sep outside of parentheses, dropping empty parts
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			if part := strings.TrimSpace(s[start:i]); part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// containerStyleProperties maps the CSS properties allowed in ContainerStyle
+// to their value validators
+var containerStyleProperties = map[string]func(string) bool{
+	"background":       isCSSBackground,
+	"background-color": isCSSColor,
+	"color":            isCSSColor,
+	"border-color":     isCSSColor,
+	"font-size":        isCSSLength,
+	"max-width":        isCSSLength,
+	"width":            isCSSLength,
+	"text-align":       func(v string) bool { return textAlignments[v] },
+	"padding":          func(v string) bool { return isCSSBoxLengths(v, false) },
+	"margin":           func(v string) bool { return isCSSBoxLengths(v, true) },
+	"border-radius":    func(v string) bool { return isCSSBoxLengths(v, false) },
+}
+
+// validateContainerStyle checks a "prop: value; ..." declaration list
+func validateContainerStyle(style string) string {
+	for _, decl := range strings.Split(style, ";") {
+		decl = strings.TrimSpace(decl)
+		if decl == "" {
+			continue
+		}
+		prop, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			return "invalid declaration " + decl
+		}
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		validate, allowed := containerStyleProperties[prop]
+		if !allowed {
+			return "property " + prop + " is not allowed"
+		}
+		if !validate(strings.TrimSpace(value)) {
+			return "invalid value for " + prop
+		}
+	}
+	return ""
+}
+
+// isSafeLink accepts absolute http(s) URLs only
+func isSafeLink(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateBanner checks all style fields and the link of a banner and returns
+// the problems keyed by field name. Empty values are allowed; the homepage
+// falls back to its defaults for them.
+func validateBanner(b BannerContent) map[string]string {
+	problems := make(map[string]string)
+	s := b.Style
+
+	check := func(field, value string, valid func(string) bool, message string) {
+		if value == "" {
+			return
+		}
+		if len(value) > maxStyleValueLength || !valid(value) {
+			problems[field] = message
+		}
+	}
+
+	check("Style.BackgroundColor", s.BackgroundColor, isCSSBackground, "must be a CSS color or gradient")
+	check("Style.Background", s.Background, isCSSBackground, "must be a CSS color or gradient")
+	check("Style.TextColor", s.TextColor, isCSSColor, "must be a CSS color")
+	check("Style.FontSize", s.FontSize, isCSSLength, "must be a length such as 16px or 1.2em")
+	check("Style.Padding", s.Padding, func(v string) bool { return isCSSBoxLengths(v, false) }, "must be one to four lengths")
+	check("Style.Margin", s.Margin, func(v string) bool { return isCSSBoxLengths(v, true) }, "must be one to four lengths or auto")
+	check("Style.BorderRadius", s.BorderRadius, func(v string) bool { return isCSSBoxLengths(v, false) }, "must be one to four lengths")
+	check("Style.TextAlign", s.TextAlign, func(v string) bool { return textAlignments[v] }, "must be left, right, center or justify")
+	check("Style.ImagePosition", s.ImagePosition, func(v string) bool { return imagePositions[v] }, "must be left, right, center or custom")
+
+	if s.ContainerStyle != "" {
+		if len(s.ContainerStyle) > maxContainerStyleLen {
+			problems["Style.ContainerStyle"] = "is too long"
+		} else if problem := validateContainerStyle(s.ContainerStyle); problem != "" {
+			problems["Style.ContainerStyle"] = problem
+		}
+	}
+
+	if s.ImageWidth < 0 || s.ImageWidth > 4000 {
+		problems["Style.ImageWidth"] = "must be between 0 and 4000"
+	}
+	if s.ImageHeight < 0 || s.ImageHeight > 4000 {
+		problems["Style.ImageHeight"] = "must be between 0 and 4000"
+	}
+
+	if b.Link != "" && (len(b.Link) > maxBannerLinkLength || !isSafeLink(b.Link)) {
+		problems["Link"] = "must be an absolute http or https URL"
+	}
+	if len(b.Text) > maxBannerTextLength {
+		problems["Text"] = "is too long"
+	}
+
+	return problems
+}
+
+// writeValidationErrors responds with 400 and every invalid field
+func writeValidationErrors(w http.ResponseWriter, problems map[string]string) {
+	fields := make([]string, 0, len(problems))
+	for field := range problems {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	type fieldError struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+	errs := make([]fieldError, 0, len(fields))
+	for _, field := range fields {
+		errs = append(errs, fieldError{Field: field, Message: problems[field]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Invalid banner fields",
+		"fields": errs,
+	})
+}
+
+// Rich text allowed in banner Text. Other elements are unwrapped to their
+// text content; dangerous ones are dropped including their content.
+var (
+	allowedTextTags = map[atom.Atom]bool{
+		atom.B: true, atom.Strong: true, atom.I: true, atom.Em: true, atom.U: true,
+		atom.S: true, atom.Strike: true, atom.Br: true, atom.P: true, atom.Div: true,
+		atom.Span: true, atom.Ul: true, atom.Ol: true, atom.Li: true, atom.A: true,
+	}
+	droppedTextTags = map[atom.Atom]bool{
+		atom.Script: true, atom.Style: true, atom.Iframe: true, atom.Object: true,
+		atom.Embed: true, atom.Template: true, atom.Noscript: true, atom.Svg: true,
+		atom.Math: true, atom.Form: true, atom.Input: true, atom.Textarea: true,
+		atom.Select: true, atom.Button: true, atom.Link: true, atom.Meta: true,
+	}
+)
+
+// sanitizeBannerHTML reduces the banner text to the allowed rich text subset.
+// Links keep only http(s) and mailto targets.
+func sanitizeBannerHTML(input string) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		return html.EscapeString(input)
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		writeSanitizedNode(&buf, n)
+	}
+	return buf.String()
+}
+
+func writeSanitizedNode(buf *bytes.Buffer, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		buf.WriteString(html.EscapeString(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		// Comments, doctypes and the like are dropped
+		return
+	}
+
+	if droppedTextTags[n.DataAtom] {
+		return
+	}
+
+	allowed := allowedTextTags[n.DataAtom]
+	if allowed {
+		buf.WriteString("<" + n.Data)
+		if n.DataAtom == atom.A {
+			for _, attr := range n.Attr {
+				if attr.Namespace == "" && attr.Key == "href" && isSafeTextLink(attr.Val) {
+					buf.WriteString(` href="` + html.EscapeString(attr.Val) + `" target="_blank" rel="noopener noreferrer"`)
+					break
+				}
+			}
+		}
+		buf.WriteString(">")
+		if n.DataAtom == atom.Br {
+			return
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeSanitizedNode(buf, c)
+	}
+
+	if allowed {
+		buf.WriteString("</" + n.Data + ">")
+	}
+}
+
+func isSafeTextLink(link string) bool {
+	if strings.HasPrefix(strings.ToLower(link), "mailto:") {
+		return !strings.ContainsAny(link, "<>\"'")
+	}
+	return isSafeLink(link)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const bannerListFile = "data/banners.json"
+
+// legacyScheduledBannersFile held the scheduled banners before they became a
+// collection of concurrent banners; it is converted once on startup
+const legacyScheduledBannersFile = "data/scheduled_banners.json"
+
+// defaultBannerID identifies the fallback banner in list responses
+const defaultBannerID = "default"
+
+// bannerList holds the banners shown alongside each other, each with an
+// optional schedule. Guarded by bannerLock together with the default banner.
+var bannerList []BannerContent
+
+func init() {
+	data, err := ioutil.ReadFile(bannerListFile)
+	if os.IsNotExist(err) {
+		migrateScheduledBanners()
+		return
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &bannerList); err != nil {
+			log.Printf("Error loading banners: %v", err)
+		}
+	}
+}
+
+// migrateScheduledBanners converts the scheduled banners into the banner
+// collection. They keep their schedule and are shown as info banners at the
+// top; overlapping ones are still ordered by start time. The old file is left
+// in place, it is not read again once the collection exists.
+func migrateScheduledBanners() {
+	data, err := ioutil.ReadFile(legacyScheduledBannersFile)
+	if err != nil {
+		return
+	}
+	var scheduled []BannerContent
+	if err := json.Unmarshal(data, &scheduled); err != nil {
+		log.Printf("Error loading scheduled banners: %v", err)
+		return
+	}
+	for i := range scheduled {
+		if scheduled[i].Severity == "" {
+			scheduled[i].Severity = SeverityInfo
+		}
+		if scheduled[i].Placement == "" {
+			scheduled[i].Placement = PlacementTop
+		}
+	}
+	bannerList = scheduled
+	if err := saveBannerList(); err != nil {
+		log.Printf("Error saving migrated banners: %v", err)
+		return
+	}
+	log.Printf("Migrated %d scheduled banners from %s to %s", len(scheduled), legacyScheduledBannersFile, bannerListFile)
+}
+
+// isActive reports whether the banner is visible and its schedule window contains t
+func (b BannerContent) isActive(t time.Time) bool {
+	if !b.Style.IsVisible {
+		return false
+	}
+	if b.ValidFrom != nil && t.Before(*b.ValidFrom) {
+		return false
+	}
+	if b.ValidUntil != nil && !t.Before(*b.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// activeBanners returns the banners active at t ordered by priority, severity
+// and start time, restricted to placement when given and to banners whose
+// audience includes viewer (all banners when viewer is nil). Falls back to
+// the default banner when no banner from the list is active.
+func activeBanners(t time.Time, placement string, viewer *bannerViewer) []BannerContent {
+	bannerLock.RLock()
+	defer bannerLock.RUnlock()
+
+	active := []BannerContent{}
+	for _, b := range bannerList {
+		if !b.isActive(t) {
+			continue
+		}
+		if placement != "" && b.Placement != placement {
+			continue
+		}
+		if !b.Audience.matches(viewer) {
+			continue
+		}
+		active = append(active, b)
+	}
+
+	if len(active) == 0 {
+		if placement != "" && placement != PlacementTop {
+			return active
+		}
+		fallback := banner
+		fallback.ID = defaultBannerID
+		if !fallback.Audience.matches(viewer) {
+			return active
+		}
+		return append(active, fallback)
+	}
+
+	sort.SliceStable(active, func(i, j int) bool {
+		a, b := active[i], active[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if severityRank[a.Severity] != severityRank[b.Severity] {
+			return severityRank[a.Severity] > severityRank[b.Severity]
+		}
+		return startsAfter(&a, &b)
+	})
+	return active
+}
+
+func startsAfter(a, b *BannerContent) bool {
+	if a.ValidFrom == nil {
+		return false
+	}
+	return b.ValidFrom == nil || a.ValidFrom.After(*b.ValidFrom)
+}
+
+// parseBannerTime accepts RFC 3339 or the datetime-local format (local time)
+func parseBannerTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+}
+
+// saveBannerList writes the banner collection. Callers must hold bannerLock.
+func saveBannerList() error {
+	if err := os.MkdirAll(filepath.Dir(bannerListFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(bannerList, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal banners: %w", err)
+	}
+
+	if err := ioutil.WriteFile(bannerListFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write banners: %w", err)
+	}
+	return nil
+}
+
+// GetBannerListHandler lists all banners of the collection, including inactive ones
+func GetBannerListHandler(w http.ResponseWriter, r *http.Request) {
+	bannerLock.RLock()
+	list := append([]BannerContent{}, bannerList...)
+	bannerLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// CreateBannerItemHandler adds a banner to the collection
+func CreateBannerItemHandler(w http.ResponseWriter, r *http.Request) {
+	// Hold off media deletions until the referenced image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	newBanner, ok := bannerFromForm(w, r, "")
+	if !ok {
+		return
+	}
+	newBanner.ID = fmt.Sprintf("banner_%d", time.Now().UnixNano())
+
+	bannerLock.Lock()
+	bannerList = append(bannerList, newBanner)
+	err := saveBannerList()
+	bannerLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving banners: %v", err)
+		http.Error(w, "Error saving banner data", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := recordBannerVersion(auditActor(r), newBanner.ID, newBanner, 0); err != nil {
+		log.Printf("Error recording banner version: %v", err)
+		http.Error(w, "Error saving banner history", http.StatusInternalServerError)
+		return
+	}
+	writeAudit(r, "create", "banner", newBanner.ID, nil, newBanner)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newBanner)
+}
+
+// UpdateBannerItemHandler replaces a banner of the collection
+func UpdateBannerItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// Hold off media deletions until the referenced image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	bannerLock.RLock()
+	index := bannerIndex(id)
+	currentImage := ""
+	if index >= 0 {
+		currentImage = bannerList[index].Image
+	}
+	bannerLock.RUnlock()
+
+	if index < 0 {
+		http.Error(w, "Banner not found", http.StatusNotFound)
+		return
+	}
+
+	newBanner, ok := bannerFromForm(w, r, currentImage)
+	if !ok {
+		return
+	}
+	newBanner.ID = id
+
+	bannerLock.Lock()
+	index = bannerIndex(id)
+	if index < 0 {
+		bannerLock.Unlock()
+		http.Error(w, "Banner not found", http.StatusNotFound)
+		return
+	}
+	previous := bannerList[index]
+	bannerList[index] = newBanner
+	err := saveBannerList()
+	bannerLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving banners: %v", err)
+		http.Error(w, "Error saving banner data", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := recordBannerVersion(auditActor(r), id, newBanner, 0); err != nil {
+		log.Printf("Error recording banner version: %v", err)
+		http.Error(w, "Error saving banner history", http.StatusInternalServerError)
+		return
+	}
+	writeAudit(r, "update", "banner", id, previous, newBanner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBanner)
+}
+
+// DeleteBannerItemHandler removes a banner from the collection
+func DeleteBannerItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	bannerLock.Lock()
+	index := bannerIndex(id)
+	if index < 0 {
+		bannerLock.Unlock()
+		http.Error(w, "Banner not found", http.StatusNotFound)
+		return
+	}
+	deleted := bannerList[index]
+	bannerList = append(bannerList[:index], bannerList[index+1:]...)
+	err := saveBannerList()
+	bannerLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving banners: %v", err)
+		http.Error(w, "Error saving banner data", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := recordBannerDeletion(auditActor(r), deleted); err != nil {
+		log.Printf("Error recording banner version: %v", err)
+		http.Error(w, "Error saving banner history", http.StatusInternalServerError)
+		return
+	}
+	writeAudit(r, "delete", "banner", id, deleted, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bannerIndex returns the index of the banner with the given ID, or -1.
+// Callers must hold bannerLock.
+func bannerIndex(id string) int {
+	for i, b := range bannerList {
+		if b.ID == id {
+			return i
+		}
+	}
+	return -1
+}
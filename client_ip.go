@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Networks of reverse proxies whose forwarding headers are trusted, from the
+// comma separated TRUSTED_PROXIES environment variable
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies parses TRUSTED_PROXIES
+func loadTrustedProxies() error {
+	networks, err := parseNetworks(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	trustedProxies = networks
+	if len(trustedProxies) > 0 {
+		log.Printf("Trusting forwarding headers from %d proxy networks", len(trustedProxies))
+	}
+	return nil
+}
+
+// parseNetworks parses a comma separated list of CIDRs or single addresses;
+// "loopback" and "private" are shortcuts for the respective ranges
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		var cidrs []string
+		switch strings.ToLower(entry) {
+		case "":
+			continue
+		case "loopback":
+			cidrs = []string{"127.0.0.0/8", "::1/128"}
+		case "private":
+			cidrs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+		default:
+			cidr, err := normalizeCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			cidrs = []string{cidr}
+		}
+		for _, cidr := range cidrs {
+			_, network, _ := net.ParseCIDR(cidr)
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// containsIP reports whether ip belongs to one of networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy reports whether ip belongs to a configured proxy network
+func isTrustedProxy(ip net.IP) bool {
+	return containsIP(trustedProxies, ip)
+}
+
+// fromTrustedProxy reports whether the request was sent by a trusted proxy
+func fromTrustedProxy(r *http.Request) bool {
+	return isTrustedProxy(net.ParseIP(remoteHost(r)))
+}
+
+// remoteHost returns the address of the direct peer without the port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestHost returns the host name the client requested. Behind a trusted
+// proxy r.Host names the upstream, so the first X-Forwarded-Host is used.
+func requestHost(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// clientIP returns the address of the client. Forwarding headers are only
+// used when the request comes from a trusted proxy: the Forwarded or
+// X-Forwarded-For chain is walked from the right, skipping trusted proxies,
+// and X-Real-IP is used when neither is present.
+func clientIP(r *http.Request) string {
+	remote := remoteHost(r)
+	if !isTrustedProxy(net.ParseIP(remote)) {
+		return remote
+	}
+
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(value, ",")...)
+		}
+	}
+	if len(chain) == 0 {
+		if ip := parseForwardedAddr(r.Header.Get("X-Real-IP")); ip != nil {
+			return ip.String()
+		}
+		return remote
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseForwardedAddr(chain[i])
+		if ip == nil {
+			// Obfuscated or malformed hop; nothing left of it can be trusted
+			break
+		}
+		client = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor returns the for= addresses of RFC 7239 Forwarded headers
+func forwardedFor(values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, addr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// parseForwardedAddr parses an address from a forwarding header, which may be
+// quoted, bracketed (IPv6) and carry a port
+func parseForwardedAddr(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	return net.ParseIP(strings.Trim(value, "[]"))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// locale selects the language of API messages, formatted stats and emails
+type locale string
+
+const (
+	localeCzech   locale = "cs"
+	localeEnglish locale = "en"
+
+	defaultLocale = localeCzech
+)
+
+// requestLocale picks the language from ?lang= or the Accept-Language header,
+// falling back to Czech
+func requestLocale(r *http.Request) locale {
+	if l, ok := parseLocale(r.URL.Query().Get("lang")); ok {
+		return l
+	}
+
+	best, bestQ := defaultLocale, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if l, ok := parseLocale(tag); ok && q > bestQ {
+			best, bestQ = l, q
+		}
+	}
+	return best
+}
+
+// tripEmailLocale is the language of the trip log email, which goes to a
+// fixed mailbox: TRIP_EMAIL_LANG, or Czech. The submitter's language only
+// applies to the API response.
+func tripEmailLocale() locale {
+	if l, ok := parseLocale(os.Getenv("TRIP_EMAIL_LANG")); ok {
+		return l
+	}
+	return defaultLocale
+}
+
+// parseLocale maps a language tag such as "en-US" to a supported locale
+func parseLocale(tag string) (locale, bool) {
+	primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	switch locale(primary) {
+	case localeCzech, localeEnglish:
+		return locale(primary), true
+	}
+	return "", false
+}
+
+// tr translates a message for the language of the request
+func tr(r *http.Request, format string, args ...interface{}) string {
+	return requestLocale(r).T(format, args...)
+}
+
+// T translates a message; messages are written in English and looked up in
+// czechMessages. Unknown messages are returned as they are. With args the
+// translated message is used as the format.
+func (l locale) T(format string, args ...interface{}) string {
+	if l == localeCzech {
+		if translated, ok := czechMessages[format]; ok {
+			format = translated
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Czech translations of API errors and emails, keyed by the English message
+var czechMessages = map[string]string{
+	// Visitor stats
+	"Invalid app parameter":                       "Neplatný parametr app",
+	"Invalid from parameter":                      "Neplatný parametr from",
+	"Invalid to parameter":                        "Neplatný parametr to",
+	"Invalid month parameter":                     "Neplatný parametr month",
+	"from must be before to":                      "from musí být před to",
+	"granularity must be hour or day":             "granularity musí být hour nebo day",
+	"range is too large for this granularity":     "Rozsah je pro tuto granularitu příliš velký",
+	"top must be between 1 and %d":                "top musí být mezi 1 a %d",
+	"format must be csv or xlsx":                  "format musí být csv nebo xlsx",
+	"table must be one of %s":                     "table musí být jedna z hodnot %s",
+	"Failed to load visitor stats":                "Nepodařilo se načíst statistiky návštěv",
+	"Failed to create export":                     "Nepodařilo se vytvořit export",
+	"Failed to erase visitor data":                "Nepodařilo se smazat data návštěvníka",
+	"Visitor not found":                           "Návštěvník nenalezen",
+	"VISITOR_REPORT_RECIPIENTS is not configured": "VISITOR_REPORT_RECIPIENTS není nastaveno",
+	"SMTP_PASSWORD is not configured":             "SMTP_PASSWORD není nastaveno",
+	"Failed to send report":                       "Nepodařilo se odeslat přehled",
+
+	// Apps and reservations
+	"Internal server error":               "Interní chyba serveru",
+	"Method not allowed":                  "Metoda není povolena",
+	"Error parsing form data":             "Chyba při zpracování formuláře",
+	"Name, URL, and Icon are required":    "Název, URL a ikona jsou povinné",
+	"App not found":                       "Aplikace nenalezena",
+	"Cannot update hardcoded app":         "Pevně danou aplikaci nelze upravit",
+	"Cannot delete hardcoded app":         "Pevně danou aplikaci nelze smazat",
+	"Failed to load reservations":         "Nepodařilo se načíst rezervace",
+	"Failed to save reservation":          "Nepodařilo se uložit rezervaci",
+	"Failed to save reservations":         "Nepodařilo se uložit rezervace",
+	"Failed to check availability":        "Nepodařilo se ověřit dostupnost",
+	"Invalid reservation data":            "Neplatná data rezervace",
+	"Missing required fields":             "Chybí povinná pole",
+	"Missing required parameters":         "Chybí povinné parametry",
+	"Invalid start date/time format":      "Neplatný formát data/času začátku",
+	"Invalid end date/time format":        "Neplatný formát data/času konce",
+	"End time must be after start time":   "Konec musí být po začátku",
+	"Selected time slot is not available": "Vybraný termín není volný",
+	"Reservation not found":               "Rezervace nenalezena",
+
+	// Trip log
+	"End kilometers must be greater than or equal to start kilometers": "Konečný stav tachometru musí být větší nebo roven počátečnímu",
+
+	"Only POST method is allowed":      "Povolena je pouze metoda POST",
+	"Failed to read request body":      "Nepodařilo se načíst tělo požadavku",
+	"Failed to parse JSON: %v":         "Nepodařilo se zpracovat JSON: %v",
+	"Failed to send email: %v":         "Nepodařilo se odeslat email: %v",
+	"Trip record saved and email sent": "Záznam byl úspěšně uložen a email odeslán",
+	"New company car trip record":      "Nový záznam o jízdě služebním autem",
+	"Company car trip record":          "Záznam o jízdě služebním autem",
+	"Driver and vehicle":               "Informace o řidiči a vozidle",
+	"Driver":                           "Řidič",
+	"Vehicle":                          "Vozidlo",
+	"Route":                            "Informace o trase",
+	"Destination":                      "Cíl cesty",
+	"Purpose":                          "Účel jízdy",
+	"Times":                            "Časové údaje",
+	"Departure":                        "Datum a čas odjezdu",
+	"Arrival":                          "Datum a čas příjezdu",
+	"Total duration":                   "Celková doba jízdy",
+	"Unknown":                          "Neznámá",
+	"Odometer":                         "Stav tachometru",
+	"At start":                         "Stav na začátku",
+	"At end":                           "Stav na konci",
+	"Total distance":                   "Celkem ujeto",
+	"GPS coordinates":                  "GPS Souřadnice",
+	"Coordinates":                      "Souřadnice",
+	"Show on map":                      "Zobrazit na mapě",
+	"Automatically generated email":    "Automaticky generovaný email",
+}
+
+// Day names, Monday first; index with weekdayIndex
+var dayNames = map[locale][]string{
+	localeCzech:   czechDayNames,
+	localeEnglish: {"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"},
+}
+
+// Month names; Czech dates use the genitive ("2. ledna 2025")
+var (
+	czechMonthNames = []string{
+		"leden", "únor", "březen", "duben", "květen", "červen",
+		"červenec", "srpen", "září", "říjen", "listopad", "prosinec",
+	}
+	czechMonthNamesGenitive = []string{
+		"ledna", "února", "března", "dubna", "května", "června",
+		"července", "srpna", "září", "října", "listopadu", "prosince",
+	}
+)
+
+// weekdayIndex converts time.Weekday (Sunday = 0) to an index into the
+// Monday-first day name lists
+func weekdayIndex(day time.Weekday) int {
+	return (int(day) + 6) % 7
+}
+
+func (l locale) dayName(day time.Weekday) string {
+	return dayNames[l][weekdayIndex(day)]
+}
+
+// monthYear formats a month, e.g. "září 2025" or "September 2025"
+func (l locale) monthYear(t time.Time) string {
+	if l == localeCzech {
+		return fmt.Sprintf("%s %d", czechMonthNames[t.Month()-1], t.Year())
+	}
+	return t.Format("January 2006")
+}
+
+// date formats a date, e.g. "2. ledna 2025" or "January 2, 2025"
+func (l locale) date(t time.Time) string {
+	if l == localeCzech {
+		return fmt.Sprintf("%d. %s %d", t.Day(), czechMonthNamesGenitive[t.Month()-1], t.Year())
+	}
+	return t.Format("January 2, 2006")
+}
+
+// formatTime formats a timestamp (DD.MM.YYYY HH:mm in Czech)
+func (l locale) formatTime(t time.Time) string {
+	if l == localeCzech {
+		return t.Format("02.01.2006 15:04")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// formatTimeWithDay formats a timestamp followed by the day name
+func (l locale) formatTimeWithDay(t time.Time) string {
+	return fmt.Sprintf("%s - %s", l.formatTime(t), l.dayName(t.Weekday()))
+}
+
+// plural picks the form for n: one, few (Czech 2-4) or many
+func (l locale) plural(n int, one, few, many string) string {
+	switch {
+	case n == 1:
+		return one
+	case l == localeCzech && n >= 2 && n <= 4:
+		return few
+	}
+	return many
+}
+
+// duration formats a trip duration, e.g. "2 dny, 3 h 15 min"
+func (l locale) duration(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+	if days == 0 {
+		return fmt.Sprintf("%d h %d min", hours, minutes)
+	}
+	var dayWord string
+	if l == localeCzech {
+		dayWord = l.plural(days, "den", "dny", "dní")
+	} else {
+		dayWord = l.plural(days, "day", "days", "days")
+	}
+	return fmt.Sprintf("%d %s, %d h %d min", days, dayWord, hours, minutes)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Widths generated for srcset, only those below the stored image width
+var responsiveWidths = []int{320, 640, 960, 1280, 1920}
+
+var (
+	// Names written by saveUploadedImage: prefix, content hash, optional
+	// width suffix. Their content never changes.
+	hashedUploadPattern = regexp.MustCompile(`^[a-z]+-[0-9a-f]{16}(?:-[0-9]+w)?\.(?:jpg|png|webp)$`)
+	variantWidthPattern = regexp.MustCompile(`-([0-9]+)w$`)
+)
+
+// ImageVariant is one file of an image's srcset
+type ImageVariant struct {
+	URL   string `json:"url"`
+	Width int    `json:"width"`
+	Type  string `json:"type"`
+}
+
+// cachedImageVariants are the variants of an image file with the modification
+// time they were listed at
+type cachedImageVariants struct {
+	modTime  time.Time
+	variants []ImageVariant
+}
+
+var (
+	imageVariantCache = map[string]cachedImageVariants{}
+	imageVariantLock  sync.Mutex
+)
+
+// uploadStem strips the extension and width suffix, so an image and all its
+// variants share the same stem
+func uploadStem(name string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	return variantWidthPattern.ReplaceAllString(stem, "")
+}
+
+// isImageVariant reports whether name is a generated variant of another upload
+func isImageVariant(name string) bool {
+	if !hashedUploadPattern.MatchString(name) {
+		return false
+	}
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	return variantWidthPattern.MatchString(stem) || filepath.Ext(name) == ".webp"
+}
+
+// storeImageVariants writes scaled down copies of img in the same format and,
+// when the cwebp tool is installed, WebP copies of every size. Failures are
+// logged; the original image is always usable on its own.
+func storeImageVariants(img image.Image, stem, ext string) {
+	// Variants listed while they were being written are incomplete
+	defer forgetImageVariants(stem + ext)
+
+	files := []string{stem + ext}
+	for _, width := range responsiveWidths {
+		if width >= img.Bounds().Dx() {
+			break
+		}
+		name := fmt.Sprintf("%s-%dw%s", stem, width, ext)
+		data, err := encodeImage(fitImage(img, width, 0), ext)
+		if err == nil {
+			err = writeUploadFile(name, data)
+		}
+		if err != nil {
+			log.Printf("Error storing image variant %s: %v", name, err)
+			continue
+		}
+		files = append(files, name)
+	}
+
+	cwebp, err := exec.LookPath("cwebp")
+	if err != nil {
+		return
+	}
+	for _, name := range files {
+		src := filepath.Join(uploadDir, name)
+		dst := filepath.Join(uploadDir, strings.TrimSuffix(name, ext)+".webp")
+		if out, err := exec.Command(cwebp, "-quiet", "-q", "80", "-metadata", "none", src, "-o", dst).CombinedOutput(); err != nil {
+			log.Printf("Error converting %s to WebP: %v %s", name, err, out)
+			os.Remove(dst)
+			continue
+		}
+		os.Chmod(dst, 0644)
+	}
+}
+
+// imageVariants lists the stored variants of an uploaded image, including the
+// image itself, ordered by type and width. The result is cached until the
+// image file is replaced; missing files are not cached.
+func imageVariants(imagePath string) []ImageVariant {
+	if !strings.HasPrefix(imagePath, "/uploads/") {
+		return nil
+	}
+	name := filepath.Base(imagePath)
+	if !hashedUploadPattern.MatchString(name) {
+		return nil
+	}
+
+	info, err := os.Stat(filepath.Join(uploadDir, name))
+	if err != nil {
+		return nil
+	}
+
+	imageVariantLock.Lock()
+	cached, ok := imageVariantCache[name]
+	imageVariantLock.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.variants
+	}
+
+	stem := uploadStem(name)
+	matches, _ := filepath.Glob(filepath.Join(uploadDir, stem+"*"))
+	var variants []ImageVariant
+	for _, path := range matches {
+		file := filepath.Base(path)
+		if uploadStem(file) != stem || !hashedUploadPattern.MatchString(file) {
+			continue
+		}
+		variant := ImageVariant{
+			URL:  "/uploads/" + file,
+			Type: "image/" + strings.TrimPrefix(filepath.Ext(file), "."),
+		}
+		if variant.Type == "image/jpg" {
+			variant.Type = "image/jpeg"
+		}
+		if m := variantWidthPattern.FindStringSubmatch(strings.TrimSuffix(file, filepath.Ext(file))); m != nil {
+			variant.Width, _ = strconv.Atoi(m[1])
+		} else if f, err := os.Open(path); err == nil {
+			if config, _, err := image.DecodeConfig(f); err == nil {
+				variant.Width = config.Width
+			}
+			f.Close()
+		}
+		variants = append(variants, variant)
+	}
+
+	sort.Slice(variants, func(i, j int) bool {
+		if variants[i].Type != variants[j].Type {
+			return variants[i].Type < variants[j].Type
+		}
+		return variants[i].Width < variants[j].Width
+	})
+
+	if len(variants) > 0 {
+		imageVariantLock.Lock()
+		imageVariantCache[name] = cachedImageVariants{modTime: info.ModTime(), variants: variants}
+		imageVariantLock.Unlock()
+	}
+	return variants
+}
+
+// imageSrcset builds a srcset attribute from the variants of one type
+func imageSrcset(variants []ImageVariant, contentType string) string {
+	var parts []string
+	for _, v := range variants {
+		if v.Type == contentType && v.Width > 0 {
+			parts = append(parts, fmt.Sprintf("%s %dw", v.URL, v.Width))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// forgetImageVariants drops cached variants after files were removed
+func forgetImageVariants(name string) {
+	stem := uploadStem(name)
+	imageVariantLock.Lock()
+	defer imageVariantLock.Unlock()
+	for cached := range imageVariantCache {
+		if uploadStem(cached) == stem {
+			delete(imageVariantCache, cached)
+		}
+	}
+}
+
+// removeImageVariants deletes the generated variants of an upload
+func removeImageVariants(name string) {
+	stem := uploadStem(name)
+	matches, _ := filepath.Glob(filepath.Join(uploadDir, stem+"*"))
+	for _, path := range matches {
+		file := filepath.Base(path)
+		if file != name && uploadStem(file) == stem && isImageVariant(file) {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error removing image variant %s: %v", path, err)
+			}
+		}
+	}
+	forgetImageVariants(name)
+}
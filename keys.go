@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwtKeysFile = "data/jwt_keys.json"
+
+	// Secret that used to be the fallback when JWT_SECRET was not set
+	defaultJWTSecret = "default-secret-key-change-in-production"
+	// Minimum length of a JWT_SECRET accepted in production mode
+	minJWTSecretLength = 32
+	// Retired keys keep validating tokens for this long after a rotation.
+	// Matches the token lifetime so no issued token is cut short.
+	jwtKeyGracePeriod = 24 * time.Hour
+	// Key ID used for the key supplied via JWT_SECRET
+	envJWTKeyID = "env"
+)
+
+// JWTKey is a single HMAC signing key
+type JWTKey struct {
+	ID        string     `json:"kid"`
+	Secret    string     `json:"secret"` // hex encoded
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// JWTKeyRing holds the active signing key and retired keys still in their grace period
+type JWTKeyRing struct {
+	CurrentID string   `json:"current_kid"`
+	Keys      []JWTKey `json:"keys"`
+
+	mu        sync.RWMutex
+	persisted bool
+}
+
+var jwtKeys = &JWTKeyRing{}
+
+// isProduction reports whether the server runs in production mode (APP_ENV=production)
+func isProduction() bool {
+	return strings.EqualFold(os.Getenv("APP_ENV"), "production")
+}
+
+// loadJWTKeys sets up the key ring. A JWT_SECRET from the environment takes
+// precedence; otherwise a random key is generated on first run and persisted
+// under data/ so tokens survive restarts.
+func loadJWTKeys() error {
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if secret == defaultJWTSecret || len(secret) < minJWTSecretLength {
+			if isProduction() {
+				return fmt.Errorf("JWT_SECRET must not be the default secret and must be at least %d characters in production", minJWTSecretLength)
+			}
+			log.Printf("Warning: JWT_SECRET is weak, set a random secret of at least %d characters", minJWTSecretLength)
+		}
+
+		jwtKeys.mu.Lock()
+		defer jwtKeys.mu.Unlock()
+		jwtKeys.CurrentID = envJWTKeyID
+		jwtKeys.Keys = []JWTKey{{
+			ID:        envJWTKeyID,
+			Secret:    hex.EncodeToString([]byte(secret)),
+			CreatedAt: time.Now(),
+		}}
+		jwtKeys.persisted = false
+		return nil
+	}
+
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+	jwtKeys.persisted = true
+
+	data, err := os.ReadFile(jwtKeysFile)
+	if err == nil {
+		if err := json.Unmarshal(data, jwtKeys); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", jwtKeysFile, err)
+		}
+		if _, ok := jwtKeys.find(jwtKeys.CurrentID); !ok {
+			return fmt.Errorf("current key %q missing from %s", jwtKeys.CurrentID, jwtKeysFile)
+		}
+		jwtKeys.prune(time.Now())
+		return jwtKeys.save()
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", jwtKeysFile, err)
+	}
+
+	log.Printf("Generating new JWT signing key in %s", jwtKeysFile)
+	key, err := newJWTKey()
+	if err != nil {
+		return err
+	}
+	jwtKeys.CurrentID = key.ID
+	jwtKeys.Keys = []JWTKey{key}
+	return jwtKeys.save()
+}
+
+func newJWTKey() (JWTKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return JWTKey{}, fmt.Errorf("failed to generate JWT key: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return JWTKey{}, fmt.Errorf("failed to generate JWT key id: %w", err)
+	}
+	return JWTKey{
+		ID:        hex.EncodeToString(id),
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// signingKey returns the key ID and secret used for new tokens
+func (k *JWTKeyRing) signingKey() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.find(k.CurrentID)
+	if !ok {
+		return "", nil, errors.New("no JWT signing key configured")
+	}
+	secret, err := hex.DecodeString(key.Secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid JWT key %s: %w", key.ID, err)
+	}
+	return key.ID, secret, nil
+}
+
+// verificationKey returns the secret for the given key ID if it is current or
+// still within its grace period. Tokens without a kid are checked against the
+// current key.
+func (k *JWTKeyRing) verificationKey(kid string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" {
+		kid = k.CurrentID
+	}
+	key, ok := k.find(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.RetiredAt != nil && time.Since(*key.RetiredAt) > jwtKeyGracePeriod {
+		return nil, fmt.Errorf("key %q has expired", kid)
+	}
+	return hex.DecodeString(key.Secret)
+}
+
+// rotate creates a new signing key and retires the current one
+func (k *JWTKeyRing) rotate() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.persisted {
+		return "", errors.New("JWT key is set via JWT_SECRET, rotate it by changing the environment")
+	}
+
+	key, err := newJWTKey()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	for i := range k.Keys {
+		if k.Keys[i].RetiredAt == nil {
+			k.Keys[i].RetiredAt = &now
+		}
+	}
+	k.Keys = append(k.Keys, key)
+	k.CurrentID = key.ID
+	k.prune(now)
+
+	if err := k.save(); err != nil {
+		return "", err
+	}
+	return key.ID, nil
+}
+
+// find looks up a key by ID. Callers must hold k.mu.
+func (k *JWTKeyRing) find(kid string) (JWTKey, bool) {
+	for _, key := range k.Keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return JWTKey{}, false
+}
+
+// prune drops retired keys whose grace period has passed. Callers must hold k.mu.
+func (k *JWTKeyRing) prune(now time.Time) {
+	kept := k.Keys[:0]
+	for _, key := range k.Keys {
+		if key.RetiredAt != nil && now.Sub(*key.RetiredAt) > jwtKeyGracePeriod {
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.Keys = kept
+}
+
+// save writes the key ring with owner-only permissions. Callers must hold k.mu.
+func (k *JWTKeyRing) save() error {
+	if !k.persisted {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(jwtKeysFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JWT keys: %w", err)
+	}
+
+	tmp := jwtKeysFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write JWT keys: %w", err)
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return fmt.Errorf("failed to set JWT key permissions: %w", err)
+	}
+	return os.Rename(tmp, jwtKeysFile)
+}
+
+// RotateJWTKeyHandler replaces the signing key. Tokens signed with the old key
+// stay valid for jwtKeyGracePeriod.
+func RotateJWTKeyHandler(w http.ResponseWriter, r *http.Request) {
+	kid, err := jwtKeys.rotate()
+	if err != nil {
+		log.Printf("Error rotating JWT key: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Printf("JWT signing key rotated, new kid %s", kid)
+	writeAudit(r, "rotate", "jwt_key", kid, nil, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"kid":          kid,
+		"grace_period": jwtKeyGracePeriod.String(),
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"strconv"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Outgoing mail account, overridable with SMTP_HOST, SMTP_PORT and SMTP_USER.
+// SMTP_PASSWORD has no default: without it no mail is sent.
+const (
+	defaultSMTPHost = "mail.pp-kunovice.cz"
+	defaultSMTPPort = 465
+	defaultSMTPUser = "sluzebnicek@pp-kunovice.cz"
+)
+
+// errMailDisabled is returned when sending mail without SMTP_PASSWORD
+var errMailDisabled = errors.New("mail is disabled: SMTP_PASSWORD is not set")
+
+// mailEnabled reports whether SMTP_PASSWORD is configured
+func mailEnabled() bool {
+	return os.Getenv("SMTP_PASSWORD") != ""
+}
+
+// newMailDialer returns the SMTP dialer and the sender address. The server
+// certificate is verified unless SMTP_INSECURE_SKIP_VERIFY is "true".
+func newMailDialer() (*gomail.Dialer, string, error) {
+	if !mailEnabled() {
+		return nil, "", errMailDisabled
+	}
+	host := envOrDefault("SMTP_HOST", defaultSMTPHost)
+	user := envOrDefault("SMTP_USER", defaultSMTPUser)
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		port = defaultSMTPPort
+	}
+
+	d := gomail.NewDialer(host, port, user, os.Getenv("SMTP_PASSWORD"))
+	if os.Getenv("SMTP_INSECURE_SKIP_VERIFY") == "true" {
+		d.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	}
+	return d, user, nil
+}
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
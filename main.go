@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,8 +14,11 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -33,61 +36,6 @@ var czechDayNames = []string{
 	"Neděle",
 }
 
-// Format time in Czech style (DD.MM.YYYY HH:mm)
-func formatCzechTime(t time.Time) string {
-	return t.Format("02.01.2006 15:04")
-}
-
-// Format time with Czech day name (DD.MM.YYYY HH:mm - DayName)
-func formatCzechTimeWithDay(t time.Time) string {
-	day := czechDayNames[t.Weekday()]
-	return fmt.Sprintf("%s - %s", formatCzechTime(t), day)
-}
-
-// Detect device type from User-Agent
-func detectDevice(userAgent string) string {
-	userAgent = strings.ToLower(userAgent)
-
-	// Mobile devices
-	if strings.Contains(userAgent, "iphone") || strings.Contains(userAgent, "ipod") {
-		return "iPhone"
-	} else if strings.Contains(userAgent, "ipad") {
-		return "iPad"
-	} else if strings.Contains(userAgent, "android") {
-		if strings.Contains(userAgent, "mobile") {
-			return "Android Phone"
-		}
-		return "Android Tablet"
-	} else if strings.Contains(userAgent, "windows phone") {
-		return "Windows Phone"
-	}
-
-	// Desktop devices
-	if strings.Contains(userAgent, "windows") {
-		return "Windows PC"
-	} else if strings.Contains(userAgent, "macintosh") || strings.Contains(userAgent, "mac os x") {
-		return "Mac"
-	} else if strings.Contains(userAgent, "linux") {
-		return "Linux PC"
-	}
-
-	// Other devices
-	if strings.Contains(userAgent, "playstation") {
-		return "PlayStation"
-	} else if strings.Contains(userAgent, "xbox") {
-		return "Xbox"
-	} else if strings.Contains(userAgent, "nintendo") {
-		return "Nintendo"
-	}
-
-	// Bots and crawlers
-	if strings.Contains(userAgent, "bot") || strings.Contains(userAgent, "crawler") {
-		return "Bot/Crawler"
-	}
-
-	return "Unknown Device"
-}
-
 type Visitor struct {
 	FirstVisit time.Time `json:"first_visit"`
 	LastVisit  time.Time `json:"last_visit"`
@@ -97,6 +45,18 @@ type Visitor struct {
 	Device     string    `json:"device"`
 	Browser    string    `json:"browser"`
 	OS         string    `json:"os"`
+	// Major browser version and OS version, when the User-Agent has them
+	BrowserVersion string `json:"browser_version,omitempty"`
+	OSVersion      string `json:"os_version,omitempty"`
+}
+
+// setUserAgentInfo stores the parsed User-Agent of a visitor
+func (v *Visitor) setUserAgentInfo(info userAgentInfo) {
+	v.Device = info.Device
+	v.Browser = info.Browser
+	v.OS = info.OS
+	v.BrowserVersion = info.BrowserVersion
+	v.OSVersion = info.OSVersion
 }
 
 type VisitorStats struct {
@@ -117,31 +77,55 @@ type VisitorStats struct {
 	} `json:"most_active_days"`
 	BrowserStats  map[string]int `json:"browser_stats"`
 	OSStats       map[string]int `json:"os_stats"`
-	ReferrerStats map[string]int `json:"referrer_stats"`
+	DeviceStats   map[string]int `json:"device_stats"`
+	ReferrerStats map[string]int `json:"referrer_stats"` // external, as host/path
+	// Internal navigation by page path, see normalizeReferrer
+	InternalReferrerStats map[string]int `json:"internal_referrer_stats"`
+	// Visits per browser and major version, e.g. "Firefox 128"
+	BrowserVersionStats map[string]int `json:"browser_version_stats"`
+	// Version of parseUserAgent the stats were recorded with, see
+	// migrateUserAgentStats
+	UserAgentParser int `json:"user_agent_parser"`
+	// Visits per hour ("2006-01-02T15", UTC) and per day ("2006-01-02", local
+	// time). TodayVisits, WeeklyVisits and MonthlyVisits are computed from these.
+	HourlyVisits map[string]int `json:"hourly_visits"`
+	DailyVisits  map[string]int `json:"daily_visits"`
+	// Whether the hourly keys are in UTC, see migrateHourlyBuckets
+	HourlyVisitsUTC bool `json:"hourly_visits_utc"`
+	// Views per page path and opens per app tile (app ID)
+	PageStats map[string]int       `json:"page_stats"`
+	AppStats  map[string]*AppUsage `json:"app_stats"`
+	// Traffic kept out of the counts above: bot visits and requests per bot
+	// name, and excluded requests per reason (bot, user_agent, ip, admin)
+	BotVisits      int            `json:"bot_visits"`
+	BotStats       map[string]int `json:"bot_stats"`
+	ExcludedVisits map[string]int `json:"excluded_visits"`
+	// Sequence number of the last event applied, see replayEvents
+	LastEventSeq uint64 `json:"last_event_seq"`
 }
 
-// Format VisitorStats with Czech dates
-func (v *VisitorStats) FormatForDisplay() map[string]interface{} {
+// FormatForDisplay formats the dates and day names of the stats for l
+func (v *VisitorStats) FormatForDisplay(l locale) map[string]interface{} {
 	displayStats := map[string]interface{}{
 		"total_visits":      v.TotalVisits,
 		"today_visits":      v.TodayVisits,
-		"last_visit":        formatCzechTimeWithDay(v.LastVisit),
+		"last_visit":        l.formatTimeWithDay(v.LastVisit),
 		"monthly_visits":    v.MonthlyVisits,
 		"weekly_visits":     v.WeeklyVisits,
-		"last_updated":      formatCzechTimeWithDay(v.LastUpdated),
+		"last_updated":      l.formatTimeWithDay(v.LastUpdated),
 		"unique_visitors":   make(map[string]interface{}),
 		"most_active_hours": make([]map[string]interface{}, len(v.MostActiveHours)),
-		"most_active_days":  make([]map[string]interface{}, len(v.MostActiveDays)),
 		"browser_stats":     v.BrowserStats,
 		"os_stats":          v.OSStats,
+		"device_stats":      v.DeviceStats,
 		"referrer_stats":    v.ReferrerStats,
 	}
 
 	// Format unique visitors
 	for id, visitor := range v.UniqueVisitors {
 		displayStats["unique_visitors"].(map[string]interface{})[id] = map[string]interface{}{
-			"first_visit": formatCzechTimeWithDay(visitor.FirstVisit),
-			"last_visit":  formatCzechTimeWithDay(visitor.LastVisit),
+			"first_visit": l.formatTimeWithDay(visitor.FirstVisit),
+			"last_visit":  l.formatTimeWithDay(visitor.LastVisit),
 			"visits":      visitor.Visits,
 			"ip":          visitor.IP,
 			"user_agent":  visitor.UserAgent,
@@ -156,20 +140,21 @@ func (v *VisitorStats) FormatForDisplay() map[string]interface{} {
 		}
 	}
 
-	// Format most active days with Czech names
-	for i, day := range v.MostActiveDays {
-		weekday := time.Weekday(0) // Start from Monday
-		for _, czechDay := range czechDayNames {
+	// Days are stored by English name (time.Weekday.String()); init leaves
+	// empty placeholders, which are skipped
+	days := []map[string]interface{}{}
+	for _, day := range v.MostActiveDays {
+		for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
 			if day.Day == weekday.String() {
-				displayStats["most_active_days"].([]map[string]interface{})[i] = map[string]interface{}{
-					"day":   czechDay,
+				days = append(days, map[string]interface{}{
+					"day":   l.dayName(weekday),
 					"count": day.Count,
-				}
+				})
 				break
 			}
-			weekday++
 		}
 	}
+	displayStats["most_active_days"] = days
 
 	return displayStats
 }
@@ -231,7 +216,12 @@ func saveVisitorStats(stats *VisitorStats) error {
 		return fmt.Errorf("failed to marshal visitor stats: %v", err)
 	}
 
-	return os.WriteFile(visitorStatsFile, data, 0644)
+	// Write to a temporary file first so a crash never leaves a partial file
+	tmp := visitorStatsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write visitor stats: %v", err)
+	}
+	return os.Rename(tmp, visitorStatsFile)
 }
 
 func randomString(n int) string {
@@ -258,107 +248,141 @@ func getVisitorId(w http.ResponseWriter, r *http.Request) string {
 	// Generate a new unique ID
 	visitorId := fmt.Sprintf("%x", md5.Sum([]byte(time.Now().String()+randomString(16))))
 
-	// Set the cookie to expire in 1 year
+	// The cookie lives as long as the visitor's record is kept
 	http.SetCookie(w, &http.Cookie{
 		Name:     "visitor_id",
 		Value:    visitorId,
 		Path:     "/",
-		MaxAge:   365 * 24 * 60 * 60, // 1 year
+		MaxAge:   int(visitorRetention().Seconds()),
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
 
 	return visitorId
 }
 
+// trackVisit counts a page view of ?path= (default /) or, with ?app=, a click
+// on an app tile. Also accepts POST so tile clicks can use sendBeacon.
 func trackVisit(w http.ResponseWriter, r *http.Request) {
-	stats, err := loadVisitorStats()
-	if err != nil {
-		log.Printf("Error loading visitor stats: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// Visitors sending Do Not Track or who opted out get no cookie and no record
+	if trackingDisabled(r) {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	app := r.URL.Query().Get("app")
+	if app != "" && !appTargetPattern.MatchString(app) {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Invalid app parameter")), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if excluded := visitExclusion(r); excluded != "" {
+		// No cookie and no visitor record, only the counts; app clicks of
+		// excluded traffic are dropped
+		if app == "" {
+			visitorStore.track(visitEvent{
+				Time:      now,
+				UserAgent: r.UserAgent(),
+				Excluded:  excluded,
+			})
+		}
+		return
+	}
+	visitorStore.track(visitEvent{
+		Time:      now,
+		VisitorID: getVisitorId(w, r),
+		IP:        anonymizeIP(clientIP(r), now),
+		UserAgent: r.UserAgent(),
+		Referrer:  r.URL.Query().Get("ref"),
+		Host:      requestHost(r),
+		Path:      normalizeTrackedPath(r.URL.Query().Get("path")),
+		App:       app,
+	})
+}
+
+// applyVisit adds a visit to the stats. Used for live visits and when
+// replaying the event log.
+func (stats *VisitorStats) applyVisit(e visitEvent) {
 	// Initialize stats if needed
 	stats.init()
 
-	// Get visitor info
-	visitorId := getVisitorId(w, r)
-	ip := r.RemoteAddr
-	userAgent := r.UserAgent()
+	// Bots and excluded traffic are counted on their own
+	if e.Excluded != "" {
+		stats.recordExcluded(e)
+		return
+	}
+
+	// App tile clicks are counted per app, not as page views
+	if e.App != "" {
+		stats.recordAppOpen(e.App, e.Time)
+		return
+	}
 
 	// Detect device information
-	device := detectDevice(userAgent)
-	browser := detectBrowser(userAgent)
-	os := detectOS(userAgent)
+	ua := parseUserAgent(e.UserAgent)
 
 	// Update visit counts
 	stats.TotalVisits++
-	stats.TodayVisits++
-	stats.LastVisit = time.Now()
-	stats.LastUpdated = time.Now()
-
-	// Reset weekly visits on Monday
-	if time.Now().Weekday() == time.Monday && stats.LastUpdated.Weekday() != time.Monday {
-		stats.WeeklyVisits = 1
-	} else {
-		stats.WeeklyVisits++
-	}
-
-	// Reset monthly visits at the start of the month
-	if stats.LastUpdated.Month() != time.Now().Month() {
-		stats.MonthlyVisits = 1
-	} else {
-		stats.MonthlyVisits++
-	}
+	stats.recordBucket(e.Time)
+	stats.refreshTotals(e.Time)
+	stats.LastVisit = e.Time
+	stats.LastUpdated = e.Time
 
 	// Update unique visitors
-	if _, ok := stats.UniqueVisitors[visitorId]; !ok {
-		stats.UniqueVisitors[visitorId] = &Visitor{
-			FirstVisit: time.Now(),
-			LastVisit:  time.Now(),
+	if _, ok := stats.UniqueVisitors[e.VisitorID]; !ok {
+		visitor := &Visitor{
+			FirstVisit: e.Time,
+			LastVisit:  e.Time,
 			Visits:     1,
-			IP:         ip,
-			UserAgent:  userAgent,
-			Device:     device,
-			Browser:    browser,
-			OS:         os,
+			IP:         e.IP,
+			UserAgent:  e.UserAgent,
 		}
+		visitor.setUserAgentInfo(ua)
+		stats.UniqueVisitors[e.VisitorID] = visitor
 	} else {
-		visitor := stats.UniqueVisitors[visitorId]
-		visitor.LastVisit = time.Now()
+		visitor := stats.UniqueVisitors[e.VisitorID]
+		visitor.LastVisit = e.Time
 		visitor.Visits++
-		stats.UniqueVisitors[visitorId] = visitor
 	}
 
-	// Update device stats
+	// Update browser stats
 	if stats.BrowserStats == nil {
 		stats.BrowserStats = make(map[string]int)
 	}
-	stats.BrowserStats[browser]++
+	stats.BrowserStats[ua.Browser]++
+	if ua.BrowserVersion != "" {
+		if stats.BrowserVersionStats == nil {
+			stats.BrowserVersionStats = make(map[string]int)
+		}
+		stats.BrowserVersionStats[ua.Browser+" "+ua.BrowserVersion]++
+	}
 
 	// Update OS stats
 	if stats.OSStats == nil {
 		stats.OSStats = make(map[string]int)
 	}
-	stats.OSStats[os]++
+	stats.OSStats[ua.OS]++
 
 	// Update device stats
-	if stats.ReferrerStats == nil {
-		stats.ReferrerStats = make(map[string]int)
+	if stats.DeviceStats == nil {
+		stats.DeviceStats = make(map[string]int)
 	}
-	stats.ReferrerStats[device]++
+	stats.DeviceStats[ua.Device]++
 
 	// Update referrer stats
-	referrer := r.Referer()
-	if referrer != "" {
-		if stats.ReferrerStats == nil {
-			stats.ReferrerStats = make(map[string]int)
-		}
-		stats.ReferrerStats[referrer]++
+	if e.Referrer != "" {
+		stats.recordReferrer(e.Referrer, e.Host)
+	}
+
+	// Update page stats; events logged before paths were tracked are homepage views
+	if e.Path == "" {
+		e.Path = "/"
 	}
+	stats.recordPage(e.Path)
 
 	// Update active hours
-	hour := time.Now().Hour()
+	hour := e.Time.Hour()
 	found := false
 	for i, h := range stats.MostActiveHours {
 		if h.Hour == hour {
@@ -375,7 +399,7 @@ func trackVisit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update active days
-	day := time.Now().Weekday().String()
+	day := e.Time.Weekday().String()
 	found = false
 	for i, d := range stats.MostActiveDays {
 		if d.Day == day {
@@ -390,69 +414,80 @@ func trackVisit(w http.ResponseWriter, r *http.Request) {
 			Count int    `json:"count"`
 		}{Day: day, Count: 1})
 	}
-
-	// Save visitor stats
-	if err := saveVisitorStats(stats); err != nil {
-		log.Printf("Error saving visitor stats: %v", err)
-	}
-}
-
-// Helper function to extract browser from User-Agent
-func detectBrowser(userAgent string) string {
-	userAgent = strings.ToLower(userAgent)
-	if strings.Contains(userAgent, "chrome") {
-		return "Chrome"
-	} else if strings.Contains(userAgent, "safari") && !strings.Contains(userAgent, "chrome") {
-		return "Safari"
-	} else if strings.Contains(userAgent, "firefox") {
-		return "Firefox"
-	} else if strings.Contains(userAgent, "msie") || strings.Contains(userAgent, "trident") {
-		return "Internet Explorer"
-	} else if strings.Contains(userAgent, "edge") {
-		return "Edge"
-	} else if strings.Contains(userAgent, "opera") {
-		return "Opera"
-	} else {
-		return "Unknown"
-	}
 }
 
-// Helper function to extract OS from User-Agent
-func detectOS(userAgent string) string {
-	userAgent = strings.ToLower(userAgent)
-	if strings.Contains(userAgent, "windows") {
-		return "Windows"
-	} else if strings.Contains(userAgent, "mac os") || strings.Contains(userAgent, "macintosh") {
-		return "macOS"
-	} else if strings.Contains(userAgent, "iphone") || strings.Contains(userAgent, "ipad") || strings.Contains(userAgent, "ipod") {
-		return "iOS"
-	} else if strings.Contains(userAgent, "android") {
-		return "Android"
-	} else if strings.Contains(userAgent, "linux") {
-		return "Linux"
-	} else if strings.Contains(userAgent, "bsd") {
-		return "BSD"
-	} else {
-		return "Unknown"
-	}
+// visitorStatsResponse adds a visit series for charts to the stats
+type visitorStatsResponse struct {
+	*VisitorStats
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	Granularity string             `json:"granularity"`
+	RangeVisits int                `json:"range_visits"`
+	Series      []visitSeriesPoint `json:"series"`
+	Apps        []appUsageSummary  `json:"apps"`
+	// The ?top= most frequent referrers and bots, the rest summed up as "other"
+	TopReferrers         []namedCount `json:"top_referrers"`
+	TopInternalReferrers []namedCount `json:"top_internal_referrers"`
+	TopBots              []namedCount `json:"top_bots"`
+	// Dates and day names formatted in the language of the request
+	Lang    locale                 `json:"lang"`
+	Display map[string]interface{} `json:"display"`
 }
 
-// Helper function to extract OS from User-Agent
-func getOSFromUserAgent(userAgent string) string {
-	return detectOS(userAgent)
-}
-
-// Get visitor stats
+// Get visitor stats. ?from= and ?to= (YYYY-MM-DD or RFC 3339) select the range
+// of the series, by default the last 30 days; ?granularity= is hour or day.
+// ?lang= or Accept-Language selects the language of the display block.
 func getVisitorStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := loadVisitorStats()
+	stats, err := visitorStore.snapshot()
 	if err != nil {
 		log.Printf("Error loading visitor stats: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	now := time.Now()
+	stats.refreshTotals(now)
+
+	q := r.URL.Query()
+	from, to, granularity, err := statsRange(q, now)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, err.Error())), http.StatusBadRequest)
+		return
+	}
+	response := visitorStatsResponse{
+		VisitorStats: stats,
+		From:         from,
+		To:           to,
+		Granularity:  granularity,
+	}
+
+	response.Series, err = stats.series(response.From, response.To, response.Granularity)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, err.Error())), http.StatusBadRequest)
+		return
+	}
+	for _, point := range response.Series {
+		response.RangeVisits += point.Count
+	}
+	response.Apps = stats.appUsage(response.From, response.To)
+
+	top := defaultTopReferrers
+	if value := q.Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxTopReferrers {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "top must be between 1 and %d", maxTopReferrers)), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	response.TopReferrers = topCounts(stats.ReferrerStats, top)
+	response.TopInternalReferrers = topCounts(stats.InternalReferrerStats, top)
+	response.TopBots = topCounts(stats.BotStats, top)
+	response.Lang = requestLocale(r)
+	response.Display = stats.FormatForDisplay(response.Lang)
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(stats); err != nil {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Error encoding visitor stats: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -522,11 +557,42 @@ func main() {
 		log.Fatalf("Failed to create uploads directory: %v", err)
 	}
 
+	// Forwarding headers are only honored from these networks
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
+	if err := loadVisitorExclusions(); err != nil {
+		log.Fatalf("Invalid visitor exclusion configuration: %v", err)
+	}
+	if !mailEnabled() {
+		log.Printf("Warning: SMTP_PASSWORD is not set, trip emails and visitor reports are disabled")
+	}
+
+	// Load or generate JWT signing keys, refusing weak secrets in production
+	if err := loadJWTKeys(); err != nil {
+		log.Fatalf("Failed to set up JWT keys: %v", err)
+	}
+
+	// Remove banner images no banner refers to anymore
+	startUploadGC()
+
+	// Write banner impression and click counters in the background
+	startBannerStatsFlush()
+
+	// Keep visitor stats in memory, replaying visits not yet in the snapshot
+	if err := visitorStore.load(); err != nil {
+		log.Fatalf("Failed to load visitor stats: %v", err)
+	}
+	startVisitorStatsFlush()
+	startMonthlyVisitorReport()
+
 	r := mux.NewRouter()
 
 	// Visitor tracking endpoints
-	r.HandleFunc("/api/track-visit", trackVisit).Methods("GET")
-	r.HandleFunc("/api/visitor-stats", getVisitorStats).Methods("GET")
+	r.HandleFunc("/api/track-visit", trackVisit).Methods("GET", "POST")
+	r.Handle("/api/visitor-stats", AuthMiddleware(http.HandlerFunc(getVisitorStats))).Methods("GET")
+	r.Handle("/api/visitor-stats/export", AuthMiddleware(http.HandlerFunc(ExportVisitorStatsHandler))).Methods("GET")
+	r.HandleFunc("/api/visitor-opt-out", VisitorOptOutHandler).Methods("POST", "DELETE")
 
 	// Set up reverse proxy to kontakt service
 	kontaktURL, _ := url.Parse("http://webportal:8080")
@@ -535,15 +601,17 @@ func main() {
 	// CORS middleware
 	corsMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Allow all origins for development
+			// Credentials are only allowed for our own and configured origins
 			origin := r.Header.Get("Origin")
-			if origin == "" {
-				origin = "*"
+			if origin != "" && isAllowedOrigin(r, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				w.Header().Add("Vary", "Origin")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
 			}
-			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
 
 			// Handle preflight requests
 			if r.Method == "OPTIONS" {
@@ -564,31 +632,20 @@ func main() {
 				return
 			}
 
-			// Check for Authorization header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Missing authorization token", http.StatusUnauthorized)
-				return
-			}
-
-			// Verify token (in a real app, you would validate this against your auth system)
-			tokenParts := strings.Split(authHeader, " ")
-			if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-				http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+			// Verify bearer token or session cookie (with CSRF check)
+			claims, err := authenticateRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), authErrorStatus(err))
 				return
 			}
 
-			// In a real app, you would validate the token here
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, withClaims(r, claims))
 		})
 	}
 
-	// Apply CORS middleware to all routes
-	r.Use(corsMiddleware)
-
 	// Public routes
 	r.PathPrefix("/kontakt/").Handler(http.StripPrefix("/kontakt", kontaktProxy))
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads"))))
+	r.PathPrefix("/uploads/").HandlerFunc(ServeUploads)
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte(`{"status":"ok"}`))
@@ -596,9 +653,13 @@ func main() {
 
 	// Authentication routes
 	r.HandleFunc("/api/login", LoginHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/login/verify", LoginVerifyHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/logout", LogoutHandler).Methods("POST", "OPTIONS")
 
 	// Public endpoints (must be defined before protected ones)
 	r.HandleFunc("/api/banner", GetBannerHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/banner/{id}/impression", BannerImpressionHandler).Methods("POST")
+	r.HandleFunc("/api/banner/{id}/click", BannerClickHandler).Methods("GET")
 	r.HandleFunc("/submit", handleSubmit).Methods("POST", "OPTIONS") // Public submit endpoint for evidence-aut.html
 
 	// Add redirect for /rezervace-aut to /rezervace-aut.html
@@ -622,6 +683,30 @@ func main() {
 	// Protected API endpoints
 	api.HandleFunc("/submit", handleSubmit).Methods("POST")
 	api.HandleFunc("/banner/update", UpdateBannerHandler).Methods("POST", "OPTIONS")
+	api.Handle("/banner/history", AuthMiddleware(http.HandlerFunc(GetBannerHistoryHandler))).Methods("GET")
+	api.Handle("/banner/history/diff", AuthMiddleware(http.HandlerFunc(GetBannerDiffHandler))).Methods("GET")
+	api.HandleFunc("/banner/rollback/{version:[0-9]+}", RollbackBannerHandler).Methods("POST")
+	api.Handle("/banner/draft", AuthMiddleware(http.HandlerFunc(GetBannerDraftHandler))).Methods("GET")
+	api.HandleFunc("/banner/draft", SaveBannerDraftHandler).Methods("POST")
+	api.HandleFunc("/banner/draft", DiscardBannerDraftHandler).Methods("DELETE")
+	api.HandleFunc("/banner/draft/preview-url", BannerPreviewURLHandler).Methods("POST")
+	api.HandleFunc("/banner/draft/publish", PublishBannerDraftHandler).Methods("POST")
+	api.Handle("/banners", AuthMiddleware(http.HandlerFunc(GetBannerListHandler))).Methods("GET")
+	api.HandleFunc("/banners", CreateBannerItemHandler).Methods("POST")
+	api.Handle("/banners/preview", AuthMiddleware(http.HandlerFunc(PreviewBannerAudienceHandler))).Methods("GET")
+	api.Handle("/banners/stats", AuthMiddleware(http.HandlerFunc(GetBannerStatsHandler))).Methods("GET")
+	api.HandleFunc("/banners/{id}", UpdateBannerItemHandler).Methods("PUT")
+	api.HandleFunc("/banners/{id}", DeleteBannerItemHandler).Methods("DELETE")
+	api.HandleFunc("/auth/rotate-key", RotateJWTKeyHandler).Methods("POST")
+
+	// Audit log (GET routes skip authMiddleware, so require a token explicitly)
+	api.Handle("/audit", AuthMiddleware(http.HandlerFunc(GetAuditHandler))).Methods("GET")
+
+	// Two-factor authentication enrollment
+	api.HandleFunc("/2fa/setup", TOTPSetupHandler).Methods("POST")
+	api.HandleFunc("/2fa/enable", TOTPEnableHandler).Methods("POST")
+	api.HandleFunc("/2fa/disable", TOTPDisableHandler).Methods("POST")
+	api.HandleFunc("/2fa/recovery-codes", TOTPRecoveryCodesHandler).Methods("POST")
 
 	// App management routes
 	api.HandleFunc("/apps", GetAppsHandler).Methods("GET")
@@ -630,6 +715,16 @@ func main() {
 	api.HandleFunc("/apps/{id}", UpdateAppHandler).Methods("PUT")
 	api.HandleFunc("/apps/{id}", DeleteAppHandler).Methods("DELETE")
 
+	// Media library
+	api.Handle("/media", AuthMiddleware(http.HandlerFunc(GetMediaHandler))).Methods("GET")
+	api.HandleFunc("/media", UploadMediaHandler).Methods("POST")
+	api.HandleFunc("/media/{name}/tags", UpdateMediaTagsHandler).Methods("PUT")
+	api.HandleFunc("/media/{name}", DeleteMediaHandler).Methods("DELETE")
+
+	// Visitor data erasure (protected by the middleware above)
+	api.HandleFunc("/visitors/{id}", EraseVisitorHandler).Methods("DELETE")
+	api.HandleFunc("/visitor-stats/report", SendVisitorReportHandler).Methods("POST")
+
 	// Admin routes - defined before the catch-all static file server
 	r.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "admin.html")
@@ -661,19 +756,46 @@ func main() {
 	fs := http.FileServer(http.Dir("."))
 	r.PathPrefix("/").Handler(fs)
 
-	// Apply CORS middleware to all routes
-	handler := enableCORS(r)
+	// Apply CORS middleware to all requests. It wraps the router instead of
+	// r.Use so preflight requests, which match no route, get the same headers.
+	handler := corsMiddleware(r)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "80"
 	}
 
+	server := &http.Server{Addr: ":" + port, Handler: handler}
+
+	// Write in-memory stats before exiting. ListenAndServe returns as soon as
+	// Shutdown starts, so wait for the running handlers to finish first.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-stop
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}()
+
 	log.Printf("Server běží na portu %s", port)
-	err := http.ListenAndServe(":"+port, handler)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Chyba při spuštění serveru: %v", err)
 	}
+	<-drained
+
+	if err := visitorStore.close(); err != nil {
+		log.Printf("Error saving visitor stats: %v", err)
+	}
+	if err := flushBannerStats(); err != nil {
+		log.Printf("Error saving banner stats: %v", err)
+	}
 }
 
 // contactHandler handles the contact page request
@@ -699,21 +821,6 @@ func contactHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "http://webportal:8080/", http.StatusFound)
 }
 
-func enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 // File path for storing apps
 const appsFile = "data/apps.json"
 
@@ -766,7 +873,7 @@ func saveApps(apps []App) error {
 func handleGetReservations(w http.ResponseWriter, r *http.Request) {
 	reservations, err := loadReservations()
 	if err != nil {
-		http.Error(w, "Nepodařilo se načíst rezervace", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to load reservations"), http.StatusInternalServerError)
 		return
 	}
 
@@ -830,7 +937,7 @@ func handleGetReservations(w http.ResponseWriter, r *http.Request) {
 func handleCreateReservation(w http.ResponseWriter, r *http.Request) {
 	var reservation Reservation
 	if err := json.NewDecoder(r.Body).Decode(&reservation); err != nil {
-		http.Error(w, "Invalid reservation data", http.StatusBadRequest)
+		http.Error(w, tr(r, "Invalid reservation data"), http.StatusBadRequest)
 		return
 	}
 
@@ -841,7 +948,7 @@ func handleCreateReservation(w http.ResponseWriter, r *http.Request) {
 	if reservation.DriverName == "" || reservation.Vehicle == "" ||
 		reservation.StartDate == "" || reservation.StartTime == "" ||
 		reservation.EndDate == "" || reservation.EndTime == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		http.Error(w, tr(r, "Missing required fields"), http.StatusBadRequest)
 		return
 	}
 
@@ -850,7 +957,7 @@ func handleCreateReservation(w http.ResponseWriter, r *http.Request) {
 		fmt.Sprintf("%s %s", reservation.StartDate, reservation.StartTime))
 	if err != nil {
 		log.Printf("Error parsing start date/time: %v", err)
-		http.Error(w, "Invalid start date/time format", http.StatusBadRequest)
+		http.Error(w, tr(r, "Invalid start date/time format"), http.StatusBadRequest)
 		return
 	}
 
@@ -858,24 +965,24 @@ func handleCreateReservation(w http.ResponseWriter, r *http.Request) {
 		fmt.Sprintf("%s %s", reservation.EndDate, reservation.EndTime))
 	if err != nil {
 		log.Printf("Error parsing end date/time: %v", err)
-		http.Error(w, "Invalid end date/time format", http.StatusBadRequest)
+		http.Error(w, tr(r, "Invalid end date/time format"), http.StatusBadRequest)
 		return
 	}
 
 	// Validate time order
 	if endDateTime.Before(startDateTime) {
-		http.Error(w, "End time must be after start time", http.StatusBadRequest)
+		http.Error(w, tr(r, "End time must be after start time"), http.StatusBadRequest)
 		return
 	}
 
 	// Check availability
 	available, err := checkReservationAvailability(reservation.Vehicle, startDateTime, endDateTime)
 	if err != nil {
-		http.Error(w, "Failed to check availability", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to check availability"), http.StatusInternalServerError)
 		return
 	}
 	if !available {
-		http.Error(w, "Selected time slot is not available", http.StatusConflict)
+		http.Error(w, tr(r, "Selected time slot is not available"), http.StatusConflict)
 		return
 	}
 
@@ -885,17 +992,19 @@ func handleCreateReservation(w http.ResponseWriter, r *http.Request) {
 	// Save reservation
 	reservations, err := loadReservations()
 	if err != nil {
-		http.Error(w, "Failed to load reservations", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to load reservations"), http.StatusInternalServerError)
 		return
 	}
 
 	reservations = append(reservations, reservation)
 
 	if err := saveReservations(reservations); err != nil {
-		http.Error(w, "Failed to save reservation", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to save reservation"), http.StatusInternalServerError)
 		return
 	}
 
+	writeAudit(r, "create", "reservation", reservation.ID, nil, reservation)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(reservation)
@@ -940,7 +1049,7 @@ func handleCheckAvailability(w http.ResponseWriter, r *http.Request) {
 
 	// Validate inputs
 	if vehicle == "" || startDate == "" || startTime == "" || endDate == "" || endTime == "" {
-		http.Error(w, "Missing required parameters", http.StatusBadRequest)
+		http.Error(w, tr(r, "Missing required parameters"), http.StatusBadRequest)
 		return
 	}
 
@@ -948,21 +1057,21 @@ func handleCheckAvailability(w http.ResponseWriter, r *http.Request) {
 	startDateTime, err := time.Parse("2006-01-02 15:04",
 		fmt.Sprintf("%s %s", startDate, startTime))
 	if err != nil {
-		http.Error(w, "Invalid start date/time format", http.StatusBadRequest)
+		http.Error(w, tr(r, "Invalid start date/time format"), http.StatusBadRequest)
 		return
 	}
 
 	endDateTime, err := time.Parse("2006-01-02 15:04",
 		fmt.Sprintf("%s %s", endDate, endTime))
 	if err != nil {
-		http.Error(w, "Invalid end date/time format", http.StatusBadRequest)
+		http.Error(w, tr(r, "Invalid end date/time format"), http.StatusBadRequest)
 		return
 	}
 
 	// Load existing reservations
 	reservations, err := loadReservations()
 	if err != nil {
-		http.Error(w, "Failed to load reservations", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to load reservations"), http.StatusInternalServerError)
 		return
 	}
 
@@ -1039,7 +1148,7 @@ func GetAppsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Only allow GET requests
 	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		http.Error(w, tr(r, "Method not allowed"), http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -1047,7 +1156,7 @@ func GetAppsHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := loadApps()
 	if err != nil {
 		log.Printf("Error loading apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
@@ -1102,7 +1211,7 @@ func GetAppsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(allApps); err != nil {
 		log.Printf("Error encoding apps to JSON: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 	}
 }
 
@@ -1121,7 +1230,7 @@ func GetAppHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := loadApps()
 	if err != nil {
 		log.Printf("Error loading apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
@@ -1142,15 +1251,19 @@ func GetAppHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(foundApp); err != nil {
 		log.Printf("Error encoding app to JSON: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 	}
 }
 
 func CreateAppHandler(w http.ResponseWriter, r *http.Request) {
+	// Hold off media deletions until the referenced image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
 	// Parse form data
 	if err := r.ParseForm(); err != nil {
 		log.Printf("Error parsing form: %v", err)
-		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		http.Error(w, tr(r, "Error parsing form data"), http.StatusBadRequest)
 		return
 	}
 
@@ -1159,10 +1272,15 @@ func CreateAppHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.FormValue("url")
 	description := r.FormValue("description")
 	iconClass := r.FormValue("iconClass")
+	icon, err := appIconFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Validate required fields
-	if name == "" || url == "" || iconClass == "" {
-		http.Error(w, "Name, URL, and Icon are required", http.StatusBadRequest)
+	if name == "" || url == "" || (iconClass == "" && icon == "") {
+		http.Error(w, tr(r, "Name, URL, and Icon are required"), http.StatusBadRequest)
 		return
 	}
 
@@ -1172,6 +1290,7 @@ func CreateAppHandler(w http.ResponseWriter, r *http.Request) {
 		Name:        strings.TrimSpace(name),
 		URL:         strings.TrimSpace(url),
 		Description: strings.TrimSpace(description),
+		Icon:        icon,
 		IconClass:   iconClass,
 		CreatedAt:   time.Now().Format(time.RFC3339),
 		UpdatedAt:   time.Now().Format(time.RFC3339),
@@ -1181,7 +1300,7 @@ func CreateAppHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := loadApps()
 	if err != nil {
 		log.Printf("Error loading apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
@@ -1192,10 +1311,12 @@ func CreateAppHandler(w http.ResponseWriter, r *http.Request) {
 	if err := saveApps(apps); err != nil {
 		log.Printf("Error saving apps: %v", err)
 		// No need to clean up files since we're not handling file uploads anymore
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
+	writeAudit(r, "create", "app", app.ID, nil, app)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(app); err != nil {
@@ -1209,14 +1330,18 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Prevent updating hardcoded apps
 	if strings.HasPrefix(appID, "hardcoded-") {
-		http.Error(w, "Cannot update hardcoded app", http.StatusForbidden)
+		http.Error(w, tr(r, "Cannot update hardcoded app"), http.StatusForbidden)
 		return
 	}
 
+	// Hold off media deletions until the referenced image is saved
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
 	// Parse form data
 	if err := r.ParseForm(); err != nil {
 		log.Printf("Error parsing form: %v", err)
-		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		http.Error(w, tr(r, "Error parsing form data"), http.StatusBadRequest)
 		return
 	}
 
@@ -1225,10 +1350,15 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.FormValue("url")
 	description := r.FormValue("description")
 	iconClass := r.FormValue("iconClass")
+	icon, err := appIconFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Validate required fields
-	if name == "" || url == "" || iconClass == "" {
-		http.Error(w, "Name, URL, and Icon are required", http.StatusBadRequest)
+	if name == "" || url == "" || (iconClass == "" && icon == "") {
+		http.Error(w, tr(r, "Name, URL, and Icon are required"), http.StatusBadRequest)
 		return
 	}
 
@@ -1236,42 +1366,50 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := loadApps()
 	if err != nil {
 		log.Printf("Error loading apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
 	// Find the app to update
 	var found bool
 	var updatedApps []App
+	var before, after App
 	for _, app := range apps {
 		if app.ID == appID {
+			before = app
 			// Update the app
 			app.Name = strings.TrimSpace(name)
 			app.URL = strings.TrimSpace(url)
 			app.Description = strings.TrimSpace(description)
 			app.IconClass = iconClass
+			if _, ok := r.Form["icon"]; ok {
+				app.Icon = icon
+			}
 			app.UpdatedAt = time.Now().Format(time.RFC3339)
+			after = app
 			found = true
 		}
 		updatedApps = append(updatedApps, app)
 	}
 
 	if !found {
-		http.Error(w, "App not found", http.StatusNotFound)
+		http.Error(w, tr(r, "App not found"), http.StatusNotFound)
 		return
 	}
 
 	// Save the updated apps
 	if err := saveApps(updatedApps); err != nil {
 		log.Printf("Error saving apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
+	writeAudit(r, "update", "app", appID, before, after)
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(updatedApps); err != nil {
 		log.Printf("Error encoding apps to JSON: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 	}
 }
 
@@ -1281,7 +1419,7 @@ func DeleteAppHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Prevent deleting hardcoded apps
 	if strings.HasPrefix(appID, "hardcoded-") {
-		http.Error(w, "Cannot delete hardcoded app", http.StatusForbidden)
+		http.Error(w, tr(r, "Cannot delete hardcoded app"), http.StatusForbidden)
 		return
 	}
 
@@ -1289,17 +1427,17 @@ func DeleteAppHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := loadApps()
 	if err != nil {
 		log.Printf("Error loading apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
 	// Find the app to delete
 	var appIndex = -1
-	var iconToDelete string
+	var deletedApp App
 	for i, app := range apps {
 		if app.ID == appID {
 			appIndex = i
-			iconToDelete = app.Icon
+			deletedApp = app
 			break
 		}
 	}
@@ -1315,38 +1453,20 @@ func DeleteAppHandler(w http.ResponseWriter, r *http.Request) {
 	// Save the updated apps
 	if err := saveApps(updatedApps); err != nil {
 		log.Printf("Error saving apps: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Internal server error"), http.StatusInternalServerError)
 		return
 	}
 
-	// If the app had an icon, check if it's used by any other app before deleting
-	if iconToDelete != "" {
-		// Check if any other app is using this icon
-		iconInUse := false
-		for _, app := range updatedApps {
-			if app.Icon == iconToDelete {
-				iconInUse = true
-				break
-			}
-		}
+	writeAudit(r, "delete", "app", appID, deletedApp, nil)
 
-		// Delete the icon file if it's not in use
-		if !iconInUse {
-			iconPath := filepath.Join("uploads", iconToDelete)
-			if _, err := os.Stat(iconPath); err == nil {
-				if err := os.Remove(iconPath); err != nil {
-					log.Printf("Error deleting icon file: %v", err)
-					// Continue even if we can't delete the file
-				}
-			}
-		}
-	}
+	// Icons are picked from the media library; the admin deletes them there
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func handleSubmit(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	loc := requestLocale(r)
 
 	if r.Method != http.MethodPost {
 		if r.Method == http.MethodOptions {
@@ -1354,7 +1474,7 @@ func handleSubmit(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte(`{"error":"Only POST method is allowed"}`))
+		w.Write([]byte(fmt.Sprintf(`{"error":%q}`, loc.T("Only POST method is allowed"))))
 		return
 	}
 
@@ -1362,7 +1482,7 @@ func handleSubmit(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Chyba při čtení těla požadavku: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":"Failed to read request body"}`))
+		w.Write([]byte(fmt.Sprintf(`{"error":%q}`, loc.T("Failed to read request body"))))
 		return
 	}
 	defer r.Body.Close()
@@ -1374,30 +1494,24 @@ func handleSubmit(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Chyba při parsování JSON: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf(`{"error":"Failed to parse JSON: %v"}`, err)))
+		w.Write([]byte(fmt.Sprintf(`{"error":%q}`, loc.T("Failed to parse JSON: %v", err))))
 		return
 	}
 
 	if entry.Name == "" || entry.Destination == "" || entry.DateStart == "" || entry.DateEnd == "" || entry.Purpose == "" {
 		log.Printf("Chybějící povinná pole: %+v", entry)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":"Missing required fields"}`))
+		w.Write([]byte(fmt.Sprintf(`{"error":%q}`, loc.T("Missing required fields"))))
 		return
 	}
 
 	if entry.KmEnd < entry.KmStart {
 		log.Printf("Neplatný stav tachometru: %d -> %d", entry.KmStart, entry.KmEnd)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":"End kilometers must be greater than or equal to start kilometers"}`))
+		w.Write([]byte(fmt.Sprintf(`{"error":%q}`, loc.T("End kilometers must be greater than or equal to start kilometers"))))
 		return
 	}
 
-	// Formátování dat do českého formátu
-	czechMonths := []string{
-		"ledna", "února", "března", "dubna", "května", "června",
-		"července", "srpna", "září", "října", "listopadu", "prosince",
-	}
-
 	// Zpracování začátku cesty
 	parsedDateStart, err := time.Parse("2006-01-02", entry.DateStart)
 	if err != nil {
@@ -1410,29 +1524,32 @@ func handleSubmit(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Chyba při parsování data konce: %v", err)
 	}
 
-	err = sendEmail(entry, parsedDateStart, parsedDateEnd, czechMonths)
+	err = sendEmail(entry, parsedDateStart, parsedDateEnd, tripEmailLocale())
 	if err != nil {
 		log.Printf("Chyba při odesílání emailu: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf(`{"error":"Failed to send email: %v"}`, err)))
+		w.Write([]byte(fmt.Sprintf(`{"error":%q}`, loc.T("Failed to send email: %v", err))))
 		return
 	}
 
+	writeAudit(r, "create", "trip", "", nil, entry)
+
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message":"Záznam byl úspěšně uložen a email odeslán"}`))
+	w.Write([]byte(fmt.Sprintf(`{"message":%q}`, loc.T("Trip record saved and email sent"))))
 }
 
-func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechMonths []string) error {
-	smtpHost := "mail.pp-kunovice.cz"
-	smtpPort := 465
-	sender := "sluzebnicek@pp-kunovice.cz"
-	password := "7g}qznB5bj"
+// sendEmail sends the trip record to the trip log mailbox in loc
+func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, loc locale) error {
+	d, sender, err := newMailDialer()
+	if err != nil {
+		return err
+	}
 	recipient := "sluzebnicek@pp-kunovice.cz"
 
 	m := gomail.NewMessage()
 	m.SetHeader("From", sender)
 	m.SetHeader("To", recipient)
-	m.SetHeader("Subject", "Nový záznam o jízdě služebním autem")
+	m.SetHeader("Subject", loc.T("New company car trip record"))
 
 	var htmlContent strings.Builder
 
@@ -1442,7 +1559,7 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
     <head>
       <meta charset="UTF-8">
       <meta name="viewport" content="width=device-width, initial-scale=1.0">
-      <title>Záznam o jízdě služebním autem</title>
+      <title>` + loc.T("Company car trip record") + `</title>
       <style>
         @media only screen and (max-width: 620px) {
           .container {
@@ -1574,7 +1691,7 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
     <body>
       <div class="container">
         <div class="header">
-          <h1>Záznam o jízdě služebním autem</h1>
+          <h1>` + loc.T("Company car trip record") + `</h1>
         </div>
         <div class="content">
     `)
@@ -1582,16 +1699,14 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
 	// Formátování dat a časů pro zobrazení
 	formattedDateStart := ""
 	if parsedDateStart.IsZero() == false {
-		monthNameStart := czechMonths[parsedDateStart.Month()-1]
-		formattedDateStart = fmt.Sprintf("%d. %s %d", parsedDateStart.Day(), monthNameStart, parsedDateStart.Year())
+		formattedDateStart = loc.date(parsedDateStart)
 	} else {
 		formattedDateStart = entry.DateStart
 	}
 
 	formattedDateEnd := ""
 	if !parsedDateEnd.IsZero() {
-		monthNameEnd := czechMonths[parsedDateEnd.Month()-1]
-		formattedDateEnd = fmt.Sprintf("%d. %s %d", parsedDateEnd.Day(), monthNameEnd, parsedDateEnd.Year())
+		formattedDateEnd = loc.date(parsedDateEnd)
 	} else {
 		formattedDateEnd = entry.DateEnd
 	}
@@ -1600,38 +1715,23 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
 	startDateTime, startErr := time.Parse("2006-01-02T15:04", fmt.Sprintf("%sT%s", entry.DateStart, entry.TimeStart))
 	endDateTime, endErr := time.Parse("2006-01-02T15:04", fmt.Sprintf("%sT%s", entry.DateEnd, entry.TimeEnd))
 
-	totalDurationStr := "Neznámá"
+	totalDurationStr := loc.T("Unknown")
 	if startErr == nil && endErr == nil {
-		diffMs := endDateTime.Sub(startDateTime)
-		if diffMs >= 0 {
-			diffDays := int(diffMs.Hours() / 24)
-			diffHours := int(diffMs.Hours()) % 24
-			diffMinutes := int(diffMs.Minutes()) % 60
-
-			if diffDays > 0 {
-				dayWord := "dní"
-				if diffDays == 1 {
-					dayWord = "den"
-				} else if diffDays >= 2 && diffDays <= 4 {
-					dayWord = "dny"
-				}
-				totalDurationStr = fmt.Sprintf("%d %s, %d h %d min", diffDays, dayWord, diffHours, diffMinutes)
-			} else {
-				totalDurationStr = fmt.Sprintf("%d h %d min", diffHours, diffMinutes)
-			}
+		if diff := endDateTime.Sub(startDateTime); diff >= 0 {
+			totalDurationStr = loc.duration(diff)
 		}
 	}
 
 	// Vypsání informací o řidiči a vozidle
 	htmlContent.WriteString(`<div class="section">
-		<div class="section-title">Informace o řidiči a vozidle</div>
+		<div class="section-title">` + loc.T("Driver and vehicle") + `</div>
 		<div class="info-row">
 		  <div class="info-item">
-			<span class="label">Řidič</span>
+			<span class="label">` + loc.T("Driver") + `</span>
 			<span class="value">` + entry.Name + `</span>
 		  </div>
 		  <div class="info-item">
-			<span class="label">Vozidlo</span>
+			<span class="label">` + loc.T("Vehicle") + `</span>
 			<span class="value">` + entry.Vehicle + `</span>
 		  </div>
 		</div>
@@ -1639,14 +1739,14 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
 
 	// Vypsání informací o trase
 	htmlContent.WriteString(`<div class="section">
-		<div class="section-title">Informace o trase</div>
+		<div class="section-title">` + loc.T("Route") + `</div>
 		<div class="info-row">
 		  <div class="info-item">
-			<span class="label">Cíl cesty</span>
+			<span class="label">` + loc.T("Destination") + `</span>
 			<span class="value">` + entry.Destination + `</span>
 		  </div>
 		  <div class="info-item">
-			<span class="label">Účel jízdy</span>
+			<span class="label">` + loc.T("Purpose") + `</span>
 			<span class="value">` + entry.Purpose + `</span>
 		  </div>
 		</div>
@@ -1654,53 +1754,53 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
 
 	// Vypsání informací o času
 	htmlContent.WriteString(`<div class="section">
-		<div class="section-title">Časové údaje</div>
+		<div class="section-title">` + loc.T("Times") + `</div>
 		<div class="info-row">
 		  <div class="info-item">
-			<span class="label">Datum a čas odjezdu</span>
+			<span class="label">` + loc.T("Departure") + `</span>
 			<span class="value">` + formattedDateStart + `, ` + entry.TimeStart + `</span>
 		  </div>
 		  <div class="info-item">
-			<span class="label">Datum a čas příjezdu</span>
+			<span class="label">` + loc.T("Arrival") + `</span>
 			<span class="value">` + formattedDateEnd + `, ` + entry.TimeEnd + `</span>
 		  </div>
 		</div>
 		<div class="highlight">
-		  <span class="label">Celková doba jízdy</span>
+		  <span class="label">` + loc.T("Total duration") + `</span>
 		  <span class="value">` + totalDurationStr + `</span>
 		</div>
 	  </div>`)
 
 	// Vypsání informací o kilometrech
 	htmlContent.WriteString(`<div class="section">
-		<div class="section-title">Stav tachometru</div>
+		<div class="section-title">` + loc.T("Odometer") + `</div>
 		<div class="info-row">
 		  <div class="info-item">
-			<span class="label">Stav na začátku</span>
+			<span class="label">` + loc.T("At start") + `</span>
 			<span class="value">` + fmt.Sprintf("%d km", entry.KmStart) + `</span>
 		  </div>
 		  <div class="info-item">
-			<span class="label">Stav na konci</span>
+			<span class="label">` + loc.T("At end") + `</span>
 			<span class="value">` + fmt.Sprintf("%d km", entry.KmEnd) + `</span>
 		  </div>
 		</div>
 		<div class="highlight">
-		  <span class="label">Celkem ujeto</span>
+		  <span class="label">` + loc.T("Total distance") + `</span>
 		  <span class="value">` + fmt.Sprintf("%d km", entry.KmEnd-entry.KmStart) + `</span>
 		</div>
 	  </div>`)
 
 	if entry.Coordinates != nil {
 		htmlContent.WriteString(`<div class="section">
-		<div class="section-title">GPS Souřadnice</div>
+		<div class="section-title">` + loc.T("GPS coordinates") + `</div>
 		<div class="info-row">
 		  <div class="info-item">
-			<span class="label">Souřadnice</span>
+			<span class="label">` + loc.T("Coordinates") + `</span>
 			<span class="value">` + entry.Coordinates.Lat + `, ` + entry.Coordinates.Lng + `</span>
 		  </div>
 		</div>
 		<a href="https://mapy.cz/zakladni?x=` + entry.Coordinates.Lng + `&y=` + entry.Coordinates.Lat + `&z=15" target="_blank" class="map-link">
-		  <i class="fas fa-map-marker-alt"></i> Zobrazit na mapě
+		  <i class="fas fa-map-marker-alt"></i> ` + loc.T("Show on map") + `
 		</a>
 	  </div>`)
 	}
@@ -1708,7 +1808,7 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
 	htmlContent.WriteString(`
         </div>
         <div class="footer">
-          &copy; 2025 Poppe + Potthoff - Automaticky generovaný email
+          &copy; 2025 Poppe + Potthoff - ` + loc.T("Automatically generated email") + `
         </div>
       </div>
     </body>
@@ -1717,9 +1817,6 @@ func sendEmail(entry TripEntry, parsedDateStart, parsedDateEnd time.Time, czechM
 
 	m.SetBody("text/html", htmlContent.String())
 
-	d := gomail.NewDialer(smtpHost, smtpPort, sender, password)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
 	return d.DialAndSend(m)
 }
 
@@ -1731,22 +1828,24 @@ func handleUpdateReservation(w http.ResponseWriter, r *http.Request) {
 
 	var updatedReservation Reservation
 	if err := json.NewDecoder(r.Body).Decode(&updatedReservation); err != nil {
-		http.Error(w, "Invalid reservation data", http.StatusBadRequest)
+		http.Error(w, tr(r, "Invalid reservation data"), http.StatusBadRequest)
 		return
 	}
 
 	// Load existing reservations
 	reservations, err := loadReservations()
 	if err != nil {
-		http.Error(w, "Failed to load reservations", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to load reservations"), http.StatusInternalServerError)
 		return
 	}
 
 	// Find and update the reservation
 	found := false
+	var previousReservation Reservation
 	for i, res := range reservations {
 		if res.ID == reservationID {
 			updatedReservation.ID = reservationID // Ensure ID remains unchanged
+			previousReservation = res
 			reservations[i] = updatedReservation
 			found = true
 			break
@@ -1754,16 +1853,18 @@ func handleUpdateReservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !found {
-		http.Error(w, "Reservation not found", http.StatusNotFound)
+		http.Error(w, tr(r, "Reservation not found"), http.StatusNotFound)
 		return
 	}
 
 	// Save updated reservations
 	if err := saveReservations(reservations); err != nil {
-		http.Error(w, "Failed to save reservation", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to save reservation"), http.StatusInternalServerError)
 		return
 	}
 
+	writeAudit(r, "update", "reservation", reservationID, previousReservation, updatedReservation)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(updatedReservation)
 }
@@ -1775,31 +1876,35 @@ func handleDeleteReservation(w http.ResponseWriter, r *http.Request) {
 	// Load existing reservations
 	reservations, err := loadReservations()
 	if err != nil {
-		http.Error(w, "Failed to load reservations", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to load reservations"), http.StatusInternalServerError)
 		return
 	}
 
 	// Find and remove the reservation
 	found := false
+	var deletedReservation Reservation
 	var updatedReservations []Reservation
 	for _, res := range reservations {
 		if res.ID == reservationID {
 			found = true
+			deletedReservation = res
 			continue
 		}
 		updatedReservations = append(updatedReservations, res)
 	}
 
 	if !found {
-		http.Error(w, "Reservation not found", http.StatusNotFound)
+		http.Error(w, tr(r, "Reservation not found"), http.StatusNotFound)
 		return
 	}
 
 	// Save updated reservations
 	if err := saveReservations(updatedReservations); err != nil {
-		http.Error(w, "Failed to save reservations", http.StatusInternalServerError)
+		http.Error(w, tr(r, "Failed to save reservations"), http.StatusInternalServerError)
 		return
 	}
 
+	writeAudit(r, "delete", "reservation", reservationID, deletedReservation, nil)
+
 	w.WriteHeader(http.StatusNoContent)
 }
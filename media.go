@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const mediaFile = "data/media.json"
+
+// Names of files in the uploads directory that the media API accepts
+var mediaNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// MediaMeta is the stored metadata of an uploaded file
+type MediaMeta struct {
+	Uploader   string    `json:"uploader,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Tags       []string  `json:"tags"`
+}
+
+// MediaItem describes a file in the uploads directory
+type MediaItem struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	ContentType string    `json:"content_type"`
+	Uploader    string    `json:"uploader,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	Tags        []string  `json:"tags"`
+	// Where the file is used, e.g. banner:default, app:app_123, banner_history:4
+	References []string `json:"references"`
+	// Generated sizes and formats for srcset, including the file itself
+	Variants []ImageVariant `json:"variants,omitempty"`
+}
+
+var (
+	mediaMeta = map[string]MediaMeta{}
+	mediaLock sync.Mutex
+)
+
+// uploadLock makes checking an upload's references and removing it atomic.
+// Deletions hold it from the check to the removal; handlers saving a banner,
+// the draft or an app hold it from validating the referenced upload until it
+// is saved. Taken before bannerLock.
+var uploadLock sync.Mutex
+
+func init() {
+	if data, err := ioutil.ReadFile(mediaFile); err == nil {
+		if err := json.Unmarshal(data, &mediaMeta); err != nil {
+			log.Printf("Error loading media metadata: %v", err)
+		}
+	}
+}
+
+// saveMediaMeta writes the metadata file. Callers must hold mediaLock.
+func saveMediaMeta() error {
+	if err := os.MkdirAll(filepath.Dir(mediaFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	data, err := json.MarshalIndent(mediaMeta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal media metadata: %w", err)
+	}
+	if err := ioutil.WriteFile(mediaFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write media metadata: %w", err)
+	}
+	return nil
+}
+
+// recordMediaUpload stores who uploaded the file at the given web path
+func recordMediaUpload(path, uploader string, tags []string) {
+	mediaLock.Lock()
+	defer mediaLock.Unlock()
+
+	if tags == nil {
+		tags = []string{}
+	}
+	mediaMeta[filepath.Base(path)] = MediaMeta{
+		Uploader:   uploader,
+		UploadedAt: time.Now(),
+		Tags:       tags,
+	}
+	if err := saveMediaMeta(); err != nil {
+		log.Printf("Error saving media metadata: %v", err)
+	}
+}
+
+// forgetMedia drops the metadata of a removed file
+func forgetMedia(name string) {
+	mediaLock.Lock()
+	defer mediaLock.Unlock()
+
+	if _, ok := mediaMeta[name]; !ok {
+		return
+	}
+	delete(mediaMeta, name)
+	if err := saveMediaMeta(); err != nil {
+		log.Printf("Error saving media metadata: %v", err)
+	}
+}
+
+// mediaPath returns the path of an upload by name or by its /uploads/ URL.
+// It fails for names outside the uploads directory and missing files.
+func mediaPath(name string) (string, error) {
+	name = strings.TrimPrefix(name, "/uploads/")
+	if !mediaNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	path := filepath.Join(uploadDir, name)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return "", fmt.Errorf("file %q not found", name)
+	}
+	return path, nil
+}
+
+// uploadReferences maps upload file names to the entities using them: the
+// published banner, the banner list, the draft, the banner history and apps
+func uploadReferences() map[string][]string {
+	refs := make(map[string][]string)
+	add := func(path, ref string) {
+		if strings.HasPrefix(path, "/uploads/") {
+			name := filepath.Base(path)
+			refs[name] = append(refs[name], ref)
+		}
+	}
+
+	bannerLock.RLock()
+	add(banner.Image, "banner:"+defaultBannerID)
+	for _, b := range bannerList {
+		add(b.Image, "banner:"+b.ID)
+	}
+	if bannerDraft != nil {
+		add(bannerDraft.Banner.Image, "banner_draft")
+	}
+	bannerLock.RUnlock()
+
+	bannerHistoryLock.Lock()
+	for _, v := range bannerHistory {
+		add(v.Banner.Image, "banner_history:"+strconv.Itoa(v.Version))
+	}
+	bannerHistoryLock.Unlock()
+
+	apps, err := loadApps()
+	if err != nil {
+		log.Printf("Error loading apps: %v", err)
+	}
+	for _, app := range apps {
+		if app.Icon != "" {
+			add("/uploads/"+app.Icon, "app:"+app.ID)
+		}
+	}
+
+	return refs
+}
+
+// appIconFromForm returns the media library file picked as app icon in the
+// "icon" form field, or "" when none is set
+func appIconFromForm(r *http.Request) (string, error) {
+	icon := r.FormValue("icon")
+	if icon == "" {
+		return "", nil
+	}
+	path, err := mediaPath(icon)
+	if err != nil {
+		return "", fmt.Errorf("invalid icon: %w", err)
+	}
+	return filepath.Base(path), nil
+}
+
+// mediaItem builds the listing entry of an upload
+func mediaItem(name string, info os.FileInfo, refs map[string][]string) MediaItem {
+	item := MediaItem{
+		Name:        name,
+		URL:         "/uploads/" + name,
+		Size:        info.Size(),
+		ContentType: "application/octet-stream",
+		UploadedAt:  info.ModTime(),
+		Tags:        []string{},
+		References:  refs[name],
+	}
+	if item.References == nil {
+		item.References = []string{}
+	}
+
+	if f, err := os.Open(filepath.Join(uploadDir, name)); err == nil {
+		if config, format, err := image.DecodeConfig(f); err == nil {
+			item.Width, item.Height = config.Width, config.Height
+			item.ContentType = "image/" + format
+		}
+		f.Close()
+	}
+
+	item.Variants = imageVariants(item.URL)
+
+	mediaLock.Lock()
+	if meta, ok := mediaMeta[name]; ok {
+		item.Uploader = meta.Uploader
+		item.UploadedAt = meta.UploadedAt
+		if meta.Tags != nil {
+			item.Tags = meta.Tags
+		}
+	}
+	mediaLock.Unlock()
+
+	return item
+}
+
+// parseTags splits a comma separated tag list, trimming and removing duplicates
+func parseTags(values ...string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// GetMediaHandler lists the files in the uploads directory, newest first.
+// ?tag= filters by tag.
+func GetMediaHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := ioutil.ReadDir(uploadDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading uploads directory: %v", err)
+		http.Error(w, `{"error":"Failed to read uploads"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	refs := uploadReferences()
+	items := []MediaItem{}
+	for _, entry := range entries {
+		// Variants are listed with the image they belong to
+		if entry.IsDir() || !mediaNamePattern.MatchString(entry.Name()) || isImageVariant(entry.Name()) {
+			continue
+		}
+		item := mediaItem(entry.Name(), entry, refs)
+		if tag != "" && !containsString(item.Tags, tag) {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].UploadedAt.After(items[j].UploadedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// UploadMediaHandler stores an image from the multipart field "file" with
+// optional comma separated "tags". The image goes through the same checks and
+// re-encoding as banner images.
+func UploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxImageUploadBytes); err != nil {
+		http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	path, err := saveUploadedImage(file, "media", 0, 0)
+	if err != nil {
+		log.Printf("Error saving media upload: %v", err)
+		if errors.Is(err, errInvalidImage) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	name := filepath.Base(path)
+	recordMediaUpload(path, auditActor(r), parseTags(r.Form["tags"]...))
+
+	info, err := os.Stat(filepath.Join(uploadDir, name))
+	if err != nil {
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+	item := mediaItem(name, info, nil)
+	writeAudit(r, "create", "media", name, nil, item)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(item)
+}
+
+// UpdateMediaTagsHandler replaces the tags of a file, body {"tags": [...]}
+func UpdateMediaTagsHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	path, err := mediaPath(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	tags := parseTags(body.Tags...)
+
+	mediaLock.Lock()
+	meta, ok := mediaMeta[name]
+	if !ok {
+		// Files uploaded before the media library have no metadata yet
+		if info, err := os.Stat(path); err == nil {
+			meta.UploadedAt = info.ModTime()
+		}
+	}
+	before := meta
+	meta.Tags = tags
+	mediaMeta[name] = meta
+	err = saveMediaMeta()
+	mediaLock.Unlock()
+	if err != nil {
+		log.Printf("Error saving media metadata: %v", err)
+		http.Error(w, "Error saving tags", http.StatusInternalServerError)
+		return
+	}
+
+	writeAudit(r, "update", "media", name, before, meta)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mediaItem(name, info, uploadReferences()))
+}
+
+// DeleteMediaHandler removes a file and its variants unless a banner, the
+// draft, a banner history version or an app still uses it. History versions
+// block the deletion so rollbacks never restore a missing image.
+func DeleteMediaHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	path, err := mediaPath(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if isImageVariant(name) {
+		http.Error(w, "Variants are deleted together with their image", http.StatusBadRequest)
+		return
+	}
+
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	if refs := uploadReferences()[name]; len(refs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      "File is still in use",
+			"references": refs,
+		})
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	before := mediaItem(name, info, nil)
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error deleting %s: %v", path, err)
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		return
+	}
+	removeImageVariants(name)
+	forgetMedia(name)
+	writeAudit(r, "delete", "media", name, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
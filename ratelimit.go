@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginAuditFile = "data/login_audit.log"
+
+	// Number of failed attempts after which the key is locked out
+	loginMaxFailures = 5
+	// How long a locked out key stays locked
+	loginLockoutDuration = 15 * time.Minute
+	// First delay after a failure, doubled with every further failure
+	loginBaseDelay = 1 * time.Second
+	// Upper bound for the progressive delay
+	loginMaxDelay = 30 * time.Second
+	// Failures older than this are forgotten
+	loginFailureWindow = 1 * time.Hour
+)
+
+// loginAttempt tracks failed logins for a single IP or username
+type loginAttempt struct {
+	Failures    int
+	LastFailure time.Time
+	NextAllowed time.Time
+	LockedUntil time.Time
+}
+
+// loginRateLimiter keeps failed login attempts per IP and per username
+type loginRateLimiter struct {
+	mu        sync.Mutex
+	byIP      map[string]*loginAttempt
+	byUser    map[string]*loginAttempt
+	lastSweep time.Time
+}
+
+var loginLimiter = newLoginRateLimiter()
+
+func newLoginRateLimiter() *loginRateLimiter {
+	return &loginRateLimiter{
+		byIP:   make(map[string]*loginAttempt),
+		byUser: make(map[string]*loginAttempt),
+	}
+}
+
+// retryAfter returns how long the caller has to wait before the next attempt
+// is allowed for the given IP and username. Zero means the attempt may proceed.
+func (l *loginRateLimiter) retryAfter(ip, username string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	wait := attemptWait(l.byIP[ip], now)
+	if userWait := attemptWait(l.byUser[strings.ToLower(username)], now); userWait > wait {
+		wait = userWait
+	}
+	return wait
+}
+
+// recordFailure registers a failed attempt and reports whether it caused a lockout
+func (l *loginRateLimiter) recordFailure(ip, username string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lockedIP := registerFailure(l.byIP, ip, now)
+	lockedUser := registerFailure(l.byUser, strings.ToLower(username), now)
+	return lockedIP || lockedUser
+}
+
+// recordSuccess clears the failure history of the IP and username
+func (l *loginRateLimiter) recordSuccess(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.byIP, ip)
+	delete(l.byUser, strings.ToLower(username))
+}
+
+// sweep drops entries that are neither locked nor recently failed.
+// Callers must hold l.mu.
+func (l *loginRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for _, attempts := range []map[string]*loginAttempt{l.byIP, l.byUser} {
+		for key, a := range attempts {
+			if now.After(a.LockedUntil) && now.Sub(a.LastFailure) > loginFailureWindow {
+				delete(attempts, key)
+			}
+		}
+	}
+}
+
+func attemptWait(a *loginAttempt, now time.Time) time.Duration {
+	if a == nil {
+		return 0
+	}
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if now.Before(a.NextAllowed) {
+		return a.NextAllowed.Sub(now)
+	}
+	return 0
+}
+
+func registerFailure(attempts map[string]*loginAttempt, key string, now time.Time) bool {
+	if key == "" {
+		return false
+	}
+
+	a, ok := attempts[key]
+	if !ok || now.Sub(a.LastFailure) > loginFailureWindow {
+		a = &loginAttempt{}
+		attempts[key] = a
+	}
+
+	a.Failures++
+	a.LastFailure = now
+
+	if a.Failures >= loginMaxFailures {
+		a.LockedUntil = now.Add(loginLockoutDuration)
+		a.Failures = 0
+		return true
+	}
+
+	// Progressive delay: 1s, 2s, 4s, ... capped at loginMaxDelay
+	delay := loginBaseDelay << (a.Failures - 1)
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	a.NextAllowed = now.Add(delay)
+	return false
+}
+
+// writeRetryAfter responds with 429 and the number of seconds to wait
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, `{"error":"Too many login attempts, try again later"}`, http.StatusTooManyRequests)
+}
+
+// LoginAuditEntry is a single line in the login audit log
+type LoginAuditEntry struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	IP       string    `json:"ip"`
+	Event    string    `json:"event"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+var loginAuditLock sync.Mutex
+
+// writeLoginAudit appends an entry to the login audit log
+func writeLoginAudit(entry LoginAuditEntry) {
+	loginAuditLock.Lock()
+	defer loginAuditLock.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling login audit entry: %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(loginAuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening login audit log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing login audit log: %v", err)
+	}
+}
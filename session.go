@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "admin_session"
+	csrfCookieName    = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+
+	// Login mode that delivers the token as an HttpOnly cookie instead of JSON
+	sessionModeCookie = "cookie"
+	sessionLifetime   = 24 * time.Hour
+)
+
+// newCSRFToken returns a random token for double-submit CSRF protection
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isSecureRequest reports whether the client reached us over HTTPS.
+// X-Forwarded-Proto is only honored from trusted proxies.
+func isSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// isMutatingMethod reports whether the method changes state and needs CSRF protection
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// checkCSRF compares the X-CSRF-Token header with the token bound to the session.
+// The token is part of the signed session claims, so a cookie planted by another
+// site cannot be used to forge it.
+func checkCSRF(r *http.Request, claims *Claims) bool {
+	header := r.Header.Get(csrfHeaderName)
+	if header == "" || claims.CSRF == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(claims.CSRF)) == 1
+}
+
+// writeSessionResponse issues the session token for an authenticated user.
+// In cookie mode the token goes into an HttpOnly cookie and only the CSRF
+// token is returned; otherwise the token is returned in the JSON body.
+func writeSessionResponse(w http.ResponseWriter, r *http.Request, username, mode string) {
+	if mode != sessionModeCookie {
+		token, err := issueToken(username, "")
+		if err != nil {
+			log.Printf("Error issuing token: %v", err)
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"token": token,
+		})
+		return
+	}
+
+	csrf, err := newCSRFToken()
+	if err != nil {
+		log.Printf("Error generating CSRF token: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	token, err := issueToken(username, csrf)
+	if err != nil {
+		log.Printf("Error issuing token: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	secure := isSecureRequest(r)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Readable by page scripts so they can echo it in the X-CSRF-Token header
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"csrf_token": csrf,
+	})
+}
+
+// LogoutHandler clears the session cookies
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == sessionCookieName,
+			Secure:   isSecureRequest(r),
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowedOrigins returns the origins from CORS_ALLOWED_ORIGINS (comma separated)
+func allowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimRight(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// isAllowedOrigin reports whether a cross-origin request may send credentials.
+// The server's own origin (the public host behind a trusted proxy) and the
+// configured origins are allowed.
+func isAllowedOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, requestHost(r)) {
+		return true
+	}
+	for _, allowed := range allowedOrigins() {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
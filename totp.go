@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpDataFile = "data/totp.json"
+	totpIssuer   = "PP Kunovice Admin"
+
+	// RFC 6238 defaults, understood by all common authenticator apps
+	totpPeriod = 30
+	totpDigits = 6
+	// Accept codes from one step before and after to tolerate clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// Lifetime of the intermediate token issued after the password step
+	mfaTokenLifetime = 5 * time.Minute
+	mfaTokenPurpose  = "mfa"
+)
+
+// TOTPEnrollment holds the second factor of a single admin user
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret,omitempty"`
+	PendingSecret string   `json:"pending_secret,omitempty"`
+	Enabled       bool     `json:"enabled"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // bcrypt hashes
+	LastStep      int64    `json:"last_step,omitempty"`      // last accepted time step, prevents replay
+}
+
+var (
+	totpUsers map[string]*TOTPEnrollment
+	totpLock  sync.Mutex
+)
+
+func init() {
+	totpUsers = make(map[string]*TOTPEnrollment)
+	if data, err := os.ReadFile(totpDataFile); err == nil {
+		if err := json.Unmarshal(data, &totpUsers); err != nil {
+			log.Printf("Error loading TOTP data: %v", err)
+		}
+	}
+}
+
+// saveTOTPData writes the enrollments. Callers must hold totpLock.
+func saveTOTPData() error {
+	if err := os.MkdirAll(filepath.Dir(totpDataFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(totpUsers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal TOTP data: %w", err)
+	}
+
+	return os.WriteFile(totpDataFile, data, 0600)
+}
+
+// totpEnabled reports whether the user has to pass the second factor
+func totpEnabled(username string) bool {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+
+	e, ok := totpUsers[username]
+	return ok && e.Enabled
+}
+
+// totpCode computes the RFC 6238 code for the given time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 section 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step matching code, or -1
+func matchTOTP(secret, code string, now time.Time) int64 {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return -1
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// totpProvisioningURI builds the otpauth:// URI encoded into the enrollment QR code
+func totpProvisioningURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns plain codes for the user and their bcrypt hashes for storage
+func newRecoveryCodes() ([]string, []string, error) {
+	plain := make([]string, 0, recoveryCodeCount)
+	hashed := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ToLower(randomString(10))
+		if len(code) != 10 {
+			return nil, nil, errors.New("failed to generate recovery code")
+		}
+		code = code[:5] + "-" + code[5:]
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		plain = append(plain, code)
+		hashed = append(hashed, string(hash))
+	}
+	return plain, hashed, nil
+}
+
+// verifySecondFactor checks a TOTP or recovery code for the user.
+// A used recovery code is removed.
+func verifySecondFactor(username, code string) bool {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+
+	e, ok := totpUsers[username]
+	if !ok || !e.Enabled {
+		return false
+	}
+
+	code = strings.TrimSpace(code)
+	if step := matchTOTP(e.Secret, strings.ReplaceAll(code, " ", ""), time.Now()); step >= 0 {
+		if step <= e.LastStep {
+			return false
+		}
+		e.LastStep = step
+		if err := saveTOTPData(); err != nil {
+			log.Printf("Error saving TOTP data: %v", err)
+		}
+		return true
+	}
+
+	for i, hash := range e.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.ToLower(code))) == nil {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			if err := saveTOTPData(); err != nil {
+				log.Printf("Error saving TOTP data: %v", err)
+			}
+			log.Printf("Recovery code used by %s, %d left", username, len(e.RecoveryCodes))
+			return true
+		}
+	}
+	return false
+}
+
+// issueMFAToken creates the short-lived token that only allows completing the login
+func issueMFAToken(username string) (string, error) {
+	kid, key, err := jwtKeys.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		Username: username,
+		Purpose:  mfaTokenPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenLifetime)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// LoginVerifyHandler completes a two-step login with a TOTP or recovery code
+func LoginVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+		Mode     string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parseToken(req.MFAToken)
+	if err != nil || claims.Purpose != mfaTokenPurpose {
+		http.Error(w, `{"error":"Invalid or expired login session"}`, http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(r)
+	now := time.Now()
+	if wait := loginLimiter.retryAfter(ip, claims.Username, now); wait > 0 {
+		writeLoginAudit(LoginAuditEntry{Time: now, Username: claims.Username, IP: ip, Event: "mfa_blocked", Reason: "rate limited"})
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	if !verifySecondFactor(claims.Username, req.Code) {
+		loginLimiter.recordFailure(ip, claims.Username, now)
+		writeLoginAudit(LoginAuditEntry{Time: now, Username: claims.Username, IP: ip, Event: "mfa_failed", Reason: "invalid code"})
+		http.Error(w, `{"error":"Invalid verification code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	loginLimiter.recordSuccess(ip, claims.Username)
+	writeLoginAudit(LoginAuditEntry{Time: now, Username: claims.Username, IP: ip, Event: "login_success", Reason: "second factor"})
+
+	writeSessionResponse(w, r, claims.Username, req.Mode)
+}
+
+// TOTPSetupHandler starts enrollment and returns the secret and provisioning URI
+func TOTPSetupHandler(w http.ResponseWriter, r *http.Request) {
+	username := requestUsername(r)
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Printf("Error creating TOTP secret: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	totpLock.Lock()
+	e, ok := totpUsers[username]
+	if !ok {
+		e = &TOTPEnrollment{}
+		totpUsers[username] = e
+	}
+	e.PendingSecret = secret
+	err = saveTOTPData()
+	totpLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving TOTP data: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(username, secret),
+	})
+}
+
+// TOTPEnableHandler confirms enrollment with a code from the authenticator app
+// and returns the recovery codes. They are shown only once.
+func TOTPEnableHandler(w http.ResponseWriter, r *http.Request) {
+	username := requestUsername(r)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	totpLock.Lock()
+	defer totpLock.Unlock()
+
+	e, ok := totpUsers[username]
+	if !ok || e.PendingSecret == "" {
+		http.Error(w, `{"error":"No pending enrollment, call /api/2fa/setup first"}`, http.StatusConflict)
+		return
+	}
+
+	step := matchTOTP(e.PendingSecret, strings.TrimSpace(req.Code), time.Now())
+	if step < 0 {
+		http.Error(w, `{"error":"Invalid verification code"}`, http.StatusBadRequest)
+		return
+	}
+
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	e.Secret = e.PendingSecret
+	e.PendingSecret = ""
+	e.Enabled = true
+	e.RecoveryCodes = hashed
+	e.LastStep = step
+	if err := saveTOTPData(); err != nil {
+		log.Printf("Error saving TOTP data: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication enabled for %s", username)
+	writeAudit(r, "enable", "2fa", username, nil, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": plain,
+	})
+}
+
+// TOTPDisableHandler turns off the second factor after re-checking password and code
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	username := requestUsername(r)
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := checkPassword(Credentials{Username: username, Password: req.Password}); err != nil {
+		http.Error(w, `{"error":"Invalid credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	if !verifySecondFactor(username, req.Code) {
+		http.Error(w, `{"error":"Invalid verification code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	totpLock.Lock()
+	delete(totpUsers, username)
+	err := saveTOTPData()
+	totpLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving TOTP data: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication disabled for %s", username)
+	writeAudit(r, "disable", "2fa", username, nil, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": false})
+}
+
+// TOTPRecoveryCodesHandler replaces the recovery codes after verifying a TOTP code
+func TOTPRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	username := requestUsername(r)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !verifySecondFactor(username, req.Code) {
+		http.Error(w, `{"error":"Invalid verification code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	totpLock.Lock()
+	if e, ok := totpUsers[username]; ok {
+		e.RecoveryCodes = hashed
+		err = saveTOTPData()
+	}
+	totpLock.Unlock()
+
+	if err != nil {
+		log.Printf("Error saving TOTP data: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeAudit(r, "regenerate_recovery_codes", "2fa", username, nil, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": plain,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// userAgentInfo is what the visitor stats keep of a User-Agent header
+type userAgentInfo struct {
+	Browser        string
+	BrowserVersion string // major version
+	OS             string
+	OSVersion      string
+	Device         string
+	Bot            bool
+	BotName        string // matched crawler or client, e.g. "googlebot" or "curl"
+}
+
+// uaRule maps a User-Agent pattern to a name. The first submatch, if any, is
+// the version.
+type uaRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// Crawlers, monitoring and HTTP libraries. Checked before anything else
+// because many of them copy a browser's User-Agent.
+var botPattern = regexp.MustCompile(`\b[a-z]*(?:bot|crawler|spider)\b|slurp|facebookexternalhit|bingpreview|headlesschrome|phantomjs|lighthouse|pingdom|uptime|monitor|preview|curl/|wget/|python-|go-http-client|java/|okhttp|apache-httpclient|libwww-perl|node-fetch|axios/|scrapy|postman`)
+
+// Device makers whose names match botPattern, removed from the User-Agent
+// before it is checked, e.g. "Android 10; CUBOT X30"
+var botPatternExceptions = regexp.MustCompile(`\bcubot\b`)
+
+// Browsers, most specific first: Edge, Opera and the other Chromium based
+// browsers also send "Chrome/", and Chrome also sends "Safari/"
+var browserRules = []uaRule{
+	{"Edge", regexp.MustCompile(`\bedg(?:e|a|ios)?/(\d+)`)},
+	{"Opera", regexp.MustCompile(`\b(?:opr|opt)/(\d+)|\bopera(?:/| )(\d+)`)},
+	{"Samsung Internet", regexp.MustCompile(`samsungbrowser/(\d+)`)},
+	{"Yandex", regexp.MustCompile(`yabrowser/(\d+)`)},
+	{"Vivaldi", regexp.MustCompile(`vivaldi/(\d+)`)},
+	{"Firefox", regexp.MustCompile(`\b(?:firefox|fxios)/(\d+)`)},
+	{"Internet Explorer", regexp.MustCompile(`\bmsie (\d+)|trident/.*\brv:(\d+)`)},
+	{"Chrome", regexp.MustCompile(`\b(?:chrome|crios|chromium)/(\d+)`)},
+	{"Safari", regexp.MustCompile(`\bversion/(\d+).*\bsafari/`)},
+}
+
+// Operating systems. iOS and Android are checked before macOS and Linux,
+// whose names appear in their User-Agents as well. Rules with a version come
+// before the fallback rule for the same OS.
+var osRules = []uaRule{
+	{"Windows Phone", regexp.MustCompile(`windows phone(?: os)? (\d+(?:\.\d+)?)`)},
+	{"Windows", regexp.MustCompile(`windows nt (\d+\.\d+)`)},
+	{"Windows", regexp.MustCompile(`\bwindows\b`)},
+	{"iOS", regexp.MustCompile(`(?:iphone|cpu) os (\d+(?:_\d+)?)`)},
+	{"iOS", regexp.MustCompile(`\b(?:iphone|ipad|ipod)\b`)},
+	{"Android", regexp.MustCompile(`android (\d+(?:\.\d+)?)`)},
+	{"Android", regexp.MustCompile(`\bandroid\b`)},
+	{"ChromeOS", regexp.MustCompile(`\bcros\b`)},
+	{"macOS", regexp.MustCompile(`mac os x (\d+(?:[_.]\d+)?)`)},
+	{"macOS", regexp.MustCompile(`macintosh`)},
+	{"Linux", regexp.MustCompile(`\blinux\b|\bx11\b`)},
+	{"BSD", regexp.MustCompile(`bsd`)},
+}
+
+// Marketing names of Windows NT versions. Windows 11 still reports 10.0.
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.2":  "XP",
+	"5.1":  "XP",
+}
+
+// parseUserAgent detects the browser, OS and device type of a User-Agent
+// header. Unrecognized parts are reported as "Unknown".
+func parseUserAgent(userAgent string) userAgentInfo {
+	ua := strings.ToLower(userAgent)
+	info := userAgentInfo{Browser: "Unknown", OS: "Unknown"}
+
+	botUA := botPatternExceptions.ReplaceAllString(ua, "")
+	if ua == "" || botPattern.MatchString(botUA) {
+		info.Bot = true
+		info.BotName = strings.Trim(botPattern.FindString(botUA), "/-")
+		if info.BotName == "" {
+			info.BotName = "empty"
+		}
+		info.Browser = "Bot"
+		info.Device = "Bot/Crawler"
+		return info
+	}
+
+	info.Browser, info.BrowserVersion = matchUARules(browserRules, ua, info.Browser)
+	info.OS, info.OSVersion = matchUARules(osRules, ua, info.OS)
+	switch info.OS {
+	case "Windows":
+		if name, ok := windowsVersions[info.OSVersion]; ok {
+			info.OSVersion = name
+		}
+	case "iOS", "macOS":
+		info.OSVersion = strings.Replace(info.OSVersion, "_", ".", -1)
+	}
+	info.Device = detectDeviceType(ua, info.OS)
+	return info
+}
+
+// matchUARules returns the name and version of the first matching rule
+func matchUARules(rules []uaRule, ua, fallback string) (string, string) {
+	for _, rule := range rules {
+		m := rule.pattern.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		for _, version := range m[1:] {
+			if version != "" {
+				return rule.name, version
+			}
+		}
+		return rule.name, ""
+	}
+	return fallback, ""
+}
+
+// detectDeviceType classifies the device. Consoles and TVs are checked first
+// since they report desktop or mobile operating systems.
+func detectDeviceType(ua, os string) string {
+	switch {
+	case strings.Contains(ua, "xbox"):
+		return "Xbox"
+	case strings.Contains(ua, "playstation"):
+		return "PlayStation"
+	case strings.Contains(ua, "nintendo"):
+		return "Nintendo"
+	case strings.Contains(ua, "smart-tv") || strings.Contains(ua, "smarttv") || strings.Contains(ua, "tizen") ||
+		strings.Contains(ua, "web0s") || strings.Contains(ua, "webos") || strings.Contains(ua, "hbbtv"):
+		return "Smart TV"
+	case strings.Contains(ua, "ipad"):
+		return "iPad"
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod"):
+		return "iPhone"
+	}
+
+	switch os {
+	case "Android":
+		// Android tablets leave out "Mobile"
+		if strings.Contains(ua, "mobile") {
+			return "Android Phone"
+		}
+		return "Android Tablet"
+	case "Windows Phone":
+		return "Windows Phone"
+	case "Windows":
+		return "Windows PC"
+	case "macOS":
+		return "Mac"
+	case "ChromeOS":
+		return "Chromebook"
+	case "Linux", "BSD":
+		return "Linux PC"
+	}
+	return "Unknown Device"
+}
@@ -0,0 +1,165 @@
+package main
+
+import "strings"
+
+// Version of the User-Agent classification recorded in
+// VisitorStats.UserAgentParser
+const userAgentParserVersion = 1
+
+// Device names written by legacyDetectDevice, which ended up in ReferrerStats
+var legacyDeviceNames = []string{
+	"iPhone", "iPad", "Android Phone", "Android Tablet", "Windows Phone",
+	"Windows PC", "Mac", "Linux PC", "PlayStation", "Xbox", "Nintendo",
+	"Bot/Crawler", "Unknown Device",
+}
+
+// migrateUserAgentStats fixes stats recorded by the legacy detection. Device
+// counts are moved from ReferrerStats to DeviceStats, and the visits of known
+// visitors are moved to the browser, OS and device their stored User-Agent
+// is classified as now. Visitors already pruned keep their old classification.
+// Reports whether anything was migrated.
+func (v *VisitorStats) migrateUserAgentStats() bool {
+	if v.UserAgentParser >= userAgentParserVersion {
+		return false
+	}
+	if v.BrowserStats == nil {
+		v.BrowserStats = make(map[string]int)
+	}
+	if v.OSStats == nil {
+		v.OSStats = make(map[string]int)
+	}
+	if v.DeviceStats == nil {
+		v.DeviceStats = make(map[string]int)
+	}
+	if v.BrowserVersionStats == nil {
+		v.BrowserVersionStats = make(map[string]int)
+	}
+
+	for _, device := range legacyDeviceNames {
+		if count, ok := v.ReferrerStats[device]; ok {
+			v.DeviceStats[device] += count
+			delete(v.ReferrerStats, device)
+		}
+	}
+
+	for _, visitor := range v.UniqueVisitors {
+		if visitor.UserAgent == "" {
+			continue
+		}
+		info := parseUserAgent(visitor.UserAgent)
+		moveCount(v.BrowserStats, legacyDetectBrowser(visitor.UserAgent), info.Browser, visitor.Visits)
+		moveCount(v.OSStats, legacyDetectOS(visitor.UserAgent), info.OS, visitor.Visits)
+		moveCount(v.DeviceStats, legacyDetectDevice(visitor.UserAgent), info.Device, visitor.Visits)
+		if info.BrowserVersion != "" {
+			v.BrowserVersionStats[info.Browser+" "+info.BrowserVersion] += visitor.Visits
+		}
+		visitor.setUserAgentInfo(info)
+	}
+
+	v.UserAgentParser = userAgentParserVersion
+	return true
+}
+
+// moveCount moves up to n counts from one key to another, never below zero
+func moveCount(counts map[string]int, from, to string, n int) {
+	if from == to {
+		return
+	}
+	if counts[from] < n {
+		n = counts[from]
+	}
+	if n <= 0 {
+		return
+	}
+	counts[from] -= n
+	if counts[from] == 0 {
+		delete(counts, from)
+	}
+	counts[to] += n
+}
+
+// legacyDetectDevice is the device detection used before parseUserAgent
+func legacyDetectDevice(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+
+	// Mobile devices
+	if strings.Contains(userAgent, "iphone") || strings.Contains(userAgent, "ipod") {
+		return "iPhone"
+	} else if strings.Contains(userAgent, "ipad") {
+		return "iPad"
+	} else if strings.Contains(userAgent, "android") {
+		if strings.Contains(userAgent, "mobile") {
+			return "Android Phone"
+		}
+		return "Android Tablet"
+	} else if strings.Contains(userAgent, "windows phone") {
+		return "Windows Phone"
+	}
+
+	// Desktop devices
+	if strings.Contains(userAgent, "windows") {
+		return "Windows PC"
+	} else if strings.Contains(userAgent, "macintosh") || strings.Contains(userAgent, "mac os x") {
+		return "Mac"
+	} else if strings.Contains(userAgent, "linux") {
+		return "Linux PC"
+	}
+
+	// Other devices
+	if strings.Contains(userAgent, "playstation") {
+		return "PlayStation"
+	} else if strings.Contains(userAgent, "xbox") {
+		return "Xbox"
+	} else if strings.Contains(userAgent, "nintendo") {
+		return "Nintendo"
+	}
+
+	// Bots and crawlers
+	if strings.Contains(userAgent, "bot") || strings.Contains(userAgent, "crawler") {
+		return "Bot/Crawler"
+	}
+
+	return "Unknown Device"
+}
+
+// legacyDetectBrowser is the browser detection used before parseUserAgent.
+// It reported Edge and Opera as Chrome.
+func legacyDetectBrowser(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	if strings.Contains(userAgent, "chrome") {
+		return "Chrome"
+	} else if strings.Contains(userAgent, "safari") && !strings.Contains(userAgent, "chrome") {
+		return "Safari"
+	} else if strings.Contains(userAgent, "firefox") {
+		return "Firefox"
+	} else if strings.Contains(userAgent, "msie") || strings.Contains(userAgent, "trident") {
+		return "Internet Explorer"
+	} else if strings.Contains(userAgent, "edge") {
+		return "Edge"
+	} else if strings.Contains(userAgent, "opera") {
+		return "Opera"
+	} else {
+		return "Unknown"
+	}
+}
+
+// legacyDetectOS is the OS detection used before parseUserAgent. It reported
+// iOS as macOS.
+func legacyDetectOS(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	if strings.Contains(userAgent, "windows") {
+		return "Windows"
+	} else if strings.Contains(userAgent, "mac os") || strings.Contains(userAgent, "macintosh") {
+		return "macOS"
+	} else if strings.Contains(userAgent, "iphone") || strings.Contains(userAgent, "ipad") || strings.Contains(userAgent, "ipod") {
+		return "iOS"
+	} else if strings.Contains(userAgent, "android") {
+		return "Android"
+	} else if strings.Contains(userAgent, "linux") {
+		return "Linux"
+	} else if strings.Contains(userAgent, "bsd") {
+		return "BSD"
+	} else {
+		return "Unknown"
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import "testing"
+
+const (
+	edgeUA  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91"
+	operaUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36 OPR/105.0.0.0"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want userAgentInfo
+	}{
+		{
+			"Edge", edgeUA,
+			userAgentInfo{Browser: "Edge", BrowserVersion: "120", OS: "Windows", OSVersion: "10", Device: "Windows PC"},
+		},
+		{
+			"Opera", operaUA,
+			userAgentInfo{Browser: "Opera", BrowserVersion: "105", OS: "Windows", OSVersion: "10", Device: "Windows PC"},
+		},
+		{
+			"Samsung Internet",
+			"Mozilla/5.0 (Linux; Android 13; SM-S911B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36",
+			userAgentInfo{Browser: "Samsung Internet", BrowserVersion: "23", OS: "Android", OSVersion: "13", Device: "Android Phone"},
+		},
+		{
+			"Firefox on Linux",
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			userAgentInfo{Browser: "Firefox", BrowserVersion: "121", OS: "Linux", Device: "Linux PC"},
+		},
+		{
+			"Safari on macOS",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			userAgentInfo{Browser: "Safari", BrowserVersion: "17", OS: "macOS", OSVersion: "10.15", Device: "Mac"},
+		},
+		{
+			"Safari on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			userAgentInfo{Browser: "Safari", BrowserVersion: "17", OS: "iOS", OSVersion: "17.2", Device: "iPhone"},
+		},
+		{
+			"Chrome on iPhone (CriOS)",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			userAgentInfo{Browser: "Chrome", BrowserVersion: "120", OS: "iOS", OSVersion: "17.1", Device: "iPhone"},
+		},
+		{
+			"Safari on iPad",
+			"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1",
+			userAgentInfo{Browser: "Safari", BrowserVersion: "16", OS: "iOS", OSVersion: "16.6", Device: "iPad"},
+		},
+		{
+			"IE11",
+			"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko",
+			userAgentInfo{Browser: "Internet Explorer", BrowserVersion: "11", OS: "Windows", OSVersion: "7", Device: "Windows PC"},
+		},
+		{
+			"Android phone",
+			"Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			userAgentInfo{Browser: "Chrome", BrowserVersion: "120", OS: "Android", OSVersion: "10", Device: "Android Phone"},
+		},
+		{
+			"Android tablet",
+			"Mozilla/5.0 (Linux; Android 12; SM-X200) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			userAgentInfo{Browser: "Chrome", BrowserVersion: "120", OS: "Android", OSVersion: "12", Device: "Android Tablet"},
+		},
+		{
+			"CUBOT phone is not a bot",
+			"Mozilla/5.0 (Linux; Android 11; CUBOT NOTE 20 PRO) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.6045.163 Mobile Safari/537.36",
+			userAgentInfo{Browser: "Chrome", BrowserVersion: "119", OS: "Android", OSVersion: "11", Device: "Android Phone"},
+		},
+		{
+			"Windows Phone",
+			"Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Mobile Safari/537.36 Edge/15.15063",
+			userAgentInfo{Browser: "Edge", BrowserVersion: "15", OS: "Windows Phone", OSVersion: "10.0", Device: "Windows Phone"},
+		},
+		{
+			"Googlebot",
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			userAgentInfo{Browser: "Bot", OS: "Unknown", Device: "Bot/Crawler", Bot: true, BotName: "googlebot"},
+		},
+		{
+			"Googlebot smartphone",
+			"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.71 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			userAgentInfo{Browser: "Bot", OS: "Unknown", Device: "Bot/Crawler", Bot: true, BotName: "googlebot"},
+		},
+		{
+			"curl", "curl/8.4.0",
+			userAgentInfo{Browser: "Bot", OS: "Unknown", Device: "Bot/Crawler", Bot: true, BotName: "curl"},
+		},
+		{
+			"HeadlessChrome",
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.6099.109 Safari/537.36",
+			userAgentInfo{Browser: "Bot", OS: "Unknown", Device: "Bot/Crawler", Bot: true, BotName: "headlesschrome"},
+		},
+		{
+			"missing User-Agent", "",
+			userAgentInfo{Browser: "Bot", OS: "Unknown", Device: "Bot/Crawler", Bot: true, BotName: "empty"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUserAgent(tt.ua); got != tt.want {
+				t.Errorf("parseUserAgent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateUserAgentStats(t *testing.T) {
+	stats := &VisitorStats{
+		// The legacy detection counted devices as referrers and reported
+		// Edge and Opera as Chrome
+		ReferrerStats: map[string]int{"Windows PC": 3, "google.com": 1},
+		BrowserStats:  map[string]int{"Chrome": 3},
+		OSStats:       map[string]int{"Windows": 3},
+		UniqueVisitors: map[string]*Visitor{
+			"edge":  {UserAgent: edgeUA, Visits: 2, Browser: "Chrome"},
+			"opera": {UserAgent: operaUA, Visits: 1, Browser: "Chrome"},
+		},
+	}
+
+	if !stats.migrateUserAgentStats() {
+		t.Fatal("migrateUserAgentStats() = false, want true")
+	}
+
+	if _, ok := stats.ReferrerStats["Windows PC"]; ok || stats.ReferrerStats["google.com"] != 1 {
+		t.Errorf("ReferrerStats = %v, want only google.com", stats.ReferrerStats)
+	}
+	if stats.DeviceStats["Windows PC"] != 3 {
+		t.Errorf("DeviceStats = %v, want Windows PC: 3", stats.DeviceStats)
+	}
+	if stats.BrowserStats["Edge"] != 2 || stats.BrowserStats["Opera"] != 1 || stats.BrowserStats["Chrome"] != 0 {
+		t.Errorf("BrowserStats = %v, want Edge: 2, Opera: 1", stats.BrowserStats)
+	}
+	if stats.BrowserVersionStats["Edge 120"] != 2 || stats.BrowserVersionStats["Opera 105"] != 1 {
+		t.Errorf("BrowserVersionStats = %v", stats.BrowserVersionStats)
+	}
+	if stats.OSStats["Windows"] != 3 {
+		t.Errorf("OSStats = %v, want Windows: 3", stats.OSStats)
+	}
+	if v := stats.UniqueVisitors["opera"]; v.Browser != "Opera" || v.BrowserVersion != "105" {
+		t.Errorf("opera visitor = %+v", v)
+	}
+
+	if stats.migrateUserAgentStats() {
+		t.Error("second migrateUserAgentStats() = true, want false")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Reasons a visit is not counted as a visit, see visitEvent.Excluded
+const (
+	exclusionBot       = "bot"        // crawler or HTTP client, see botPattern
+	exclusionUserAgent = "user_agent" // VISITOR_EXCLUDE_USER_AGENTS
+	exclusionIP        = "ip"         // VISITOR_EXCLUDE_IPS
+	exclusionAdmin     = "admin"      // VISITOR_EXCLUDE_ADMINS
+
+	// Bot names beyond this are counted as otherBucket
+	maxTrackedBots = 100
+)
+
+// visitorExclusions are the configured rules for traffic that should not count
+// as visits, such as our own monitoring and admins checking the homepage
+var visitorExclusions struct {
+	userAgents []*regexp.Regexp
+	networks   []*net.IPNet
+	admins     []string // usernames; "*" matches every admin
+}
+
+// loadVisitorExclusions parses VISITOR_EXCLUDE_USER_AGENTS (comma separated,
+// case-insensitive regular expressions), VISITOR_EXCLUDE_IPS (networks as in
+// TRUSTED_PROXIES) and VISITOR_EXCLUDE_ADMINS (usernames or "*")
+func loadVisitorExclusions() error {
+	visitorExclusions.userAgents = nil
+	for _, pattern := range strings.Split(os.Getenv("VISITOR_EXCLUDE_USER_AGENTS"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("VISITOR_EXCLUDE_USER_AGENTS: invalid pattern %q: %w", pattern, err)
+		}
+		visitorExclusions.userAgents = append(visitorExclusions.userAgents, re)
+	}
+
+	networks, err := parseNetworks(os.Getenv("VISITOR_EXCLUDE_IPS"))
+	if err != nil {
+		return fmt.Errorf("VISITOR_EXCLUDE_IPS: %w", err)
+	}
+	visitorExclusions.networks = networks
+
+	visitorExclusions.admins = nil
+	for _, username := range strings.Split(os.Getenv("VISITOR_EXCLUDE_ADMINS"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			visitorExclusions.admins = append(visitorExclusions.admins, username)
+		}
+	}
+
+	if n := len(visitorExclusions.userAgents) + len(visitorExclusions.networks) + len(visitorExclusions.admins); n > 0 {
+		log.Printf("Excluding visits matching %d rules from the visitor stats", n)
+	}
+	return nil
+}
+
+// visitExclusion returns why a tracking request is not counted as a visit, or
+// "" for a regular visit. It runs before the IP is anonymized.
+func visitExclusion(r *http.Request) string {
+	userAgent := r.UserAgent()
+	for _, re := range visitorExclusions.userAgents {
+		if re.MatchString(userAgent) {
+			return exclusionUserAgent
+		}
+	}
+
+	if containsIP(visitorExclusions.networks, net.ParseIP(clientIP(r))) {
+		return exclusionIP
+	}
+
+	if len(visitorExclusions.admins) > 0 {
+		// Admins browsing the homepage carry their session cookie. Tracking
+		// requests are sent with sendBeacon, which cannot add the CSRF header,
+		// so only the cookie is checked; it decides nothing but the counting.
+		if claims, err := sessionCookieClaims(r); err == nil {
+			for _, username := range visitorExclusions.admins {
+				if username == "*" || username == claims.Username {
+					return exclusionAdmin
+				}
+			}
+		}
+	}
+
+	if parseUserAgent(userAgent).Bot {
+		return exclusionBot
+	}
+	return ""
+}
+
+// recordExcluded counts a visit that is not part of the visitor stats
+func (v *VisitorStats) recordExcluded(e visitEvent) {
+	if v.ExcludedVisits == nil {
+		v.ExcludedVisits = make(map[string]int)
+	}
+	v.ExcludedVisits[e.Excluded]++
+
+	if e.Excluded != exclusionBot {
+		return
+	}
+	if v.BotStats == nil {
+		v.BotStats = make(map[string]int)
+	}
+	name := parseUserAgent(e.UserAgent).BotName
+	if _, ok := v.BotStats[name]; !ok && len(v.BotStats) >= maxTrackedBots {
+		name = otherBucket
+	}
+	v.BotStats[name]++
+	v.BotVisits++
+}
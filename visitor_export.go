@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// exportTable is one table of the visitor stats export: a CSV file or a
+// worksheet of the XLSX workbook
+type exportTable struct {
+	Name   string
+	Header []string
+	Rows   [][]interface{}
+}
+
+// countRows turns a count map into rows, most frequent first
+func countRows(counts map[string]int) [][]interface{} {
+	rows := [][]interface{}{}
+	for _, entry := range sortedCounts(counts) {
+		rows = append(rows, []interface{}{entry.Name, entry.Count})
+	}
+	return rows
+}
+
+// visitorExportTables builds the export of the visit series in [from, to)
+// and the current totals of the other stats
+func visitorExportTables(stats *VisitorStats, from, to time.Time, granularity string) ([]exportTable, error) {
+	series, err := stats.series(from, to, granularity)
+	if err != nil {
+		return nil, err
+	}
+	visits := exportTable{Name: "visits", Header: []string{"start", "visits"}}
+	for _, point := range series {
+		visits.Rows = append(visits.Rows, []interface{}{point.Start.Format("2006-01-02 15:04"), point.Count})
+	}
+
+	apps := exportTable{Name: "apps", Header: []string{"id", "name", "range_opens", "total_opens", "busiest_hour", "last_used"}}
+	for _, app := range stats.appUsage(from, to) {
+		apps.Rows = append(apps.Rows, []interface{}{
+			app.ID, app.Name, app.RangeOpens, app.TotalOpens, app.BusiestHour, app.LastUsed.Format("2006-01-02 15:04"),
+		})
+	}
+
+	return []exportTable{
+		visits,
+		apps,
+		{Name: "pages", Header: []string{"path", "views"}, Rows: countRows(stats.PageStats)},
+		{Name: "browsers", Header: []string{"browser", "visits"}, Rows: countRows(stats.BrowserStats)},
+		{Name: "browser_versions", Header: []string{"browser_version", "visits"}, Rows: countRows(stats.BrowserVersionStats)},
+		{Name: "os", Header: []string{"os", "visits"}, Rows: countRows(stats.OSStats)},
+		{Name: "devices", Header: []string{"device", "visits"}, Rows: countRows(stats.DeviceStats)},
+		{Name: "referrers", Header: []string{"referrer", "visits"}, Rows: countRows(stats.ReferrerStats)},
+		{Name: "internal_referrers", Header: []string{"path", "visits"}, Rows: countRows(stats.InternalReferrerStats)},
+	}, nil
+}
+
+// ExportVisitorStatsHandler downloads the visitor stats. ?format=xlsx returns
+// a workbook with one sheet per table; ?format=csv (default) returns the table
+// named by ?table= (default visits). ?from=, ?to= and ?granularity= select the
+// visit series as for GET /api/visitor-stats.
+func ExportVisitorStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "format must be csv or xlsx")), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := visitorStore.snapshot()
+	if err != nil {
+		log.Printf("Error loading visitor stats: %v", err)
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Failed to load visitor stats")), http.StatusInternalServerError)
+		return
+	}
+	from, to, granularity, err := statsRange(q, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, err.Error())), http.StatusBadRequest)
+		return
+	}
+	tables, err := visitorExportTables(stats, from, to, granularity)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, err.Error())), http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("visitor-stats-%s-%s", from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02"))
+	if format == "xlsx" {
+		writeVisitorStatsXLSX(w, filename, tables)
+		return
+	}
+
+	name := q.Get("table")
+	if name == "" {
+		name = "visits"
+	}
+	for _, table := range tables {
+		if table.Name == name {
+			writeVisitorStatsCSV(w, filename+"-"+name, table)
+			return
+		}
+	}
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = table.Name
+	}
+	http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "table must be one of %s", strings.Join(names, ", "))), http.StatusBadRequest)
+}
+
+// csvText prefixes text that a spreadsheet would read as a formula with an
+// apostrophe. Referrers, paths and user agents come from visitors, so an
+// exported "=HYPERLINK(...)" must stay text.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func writeVisitorStatsCSV(w http.ResponseWriter, filename string, table exportTable) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+
+	cw := csv.NewWriter(w)
+	cw.Write(table.Header)
+	for _, row := range table.Rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			if text, ok := value.(string); ok {
+				record[i] = csvText(text)
+			} else {
+				record[i] = fmt.Sprint(value)
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error writing visitor stats CSV: %v", err)
+	}
+}
+
+func writeVisitorStatsXLSX(w http.ResponseWriter, filename string, tables []exportTable) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		log.Printf("Error creating XLSX style: %v", err)
+	}
+	for i, table := range tables {
+		if i == 0 {
+			err = f.SetSheetName(f.GetSheetName(0), table.Name)
+		} else {
+			_, err = f.NewSheet(table.Name)
+		}
+		if err == nil {
+			err = writeXLSXTable(f, table, bold)
+		}
+		if err != nil {
+			log.Printf("Error writing XLSX sheet %s: %v", table.Name, err)
+			http.Error(w, `{"error":"Failed to create export"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, filename))
+	if err := f.Write(w); err != nil {
+		log.Printf("Error writing visitor stats XLSX: %v", err)
+	}
+}
+
+// writeXLSXTable fills a sheet with the header row in bold and the rows below.
+// Strings are stored as text cells, never as formulas.
+func writeXLSXTable(f *excelize.File, table exportTable, headerStyle int) error {
+	if err := f.SetSheetRow(table.Name, "A1", &table.Header); err != nil {
+		return err
+	}
+	if err := f.SetRowStyle(table.Name, 1, 1, headerStyle); err != nil {
+		return err
+	}
+	for i, row := range table.Rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+		if err := f.SetSheetRow(table.Name, cell, &row); err != nil {
+			return err
+		}
+	}
+	lastColumn, err := excelize.ColumnNumberToName(len(table.Header))
+	if err != nil {
+		return err
+	}
+	return f.SetColWidth(table.Name, "A", lastColumn, 20)
+}
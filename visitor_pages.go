@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Distinct pages and apps kept in the stats; further ones are counted
+	// under otherBucket so a misbehaving client cannot grow the file
+	maxTrackedPages = 200
+	maxTrackedApps  = 200
+	otherBucket     = "other"
+
+	maxTrackedPathLength = 200
+)
+
+// App IDs sent by the homepage tiles: IDs from GetAppsHandler or the
+// hardcoded-* tiles
+var appTargetPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Names of the tiles that are part of index.html rather than data/apps.json
+var hardcodedAppNames = map[string]string{
+	"hardcoded-car":         "Záznam služebních jízd",
+	"hardcoded-lunch":       "Objednávka obědů",
+	"hardcoded-osticket":    "OSTicket",
+	"hardcoded-kanboard":    "Kanboard",
+	"hardcoded-reservation": "Rezervace služebních vozů",
+}
+
+// AppUsage counts how often an app tile was opened
+type AppUsage struct {
+	Opens    int            `json:"opens"`
+	LastUsed time.Time      `json:"last_used"`
+	Hours    [24]int        `json:"hours"` // opens by hour of day, local time
+	Daily    map[string]int `json:"daily"` // opens per day (YYYY-MM-DD)
+}
+
+// appUsageSummary is one app in the visitor stats response
+type appUsageSummary struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	RangeOpens  int       `json:"range_opens"` // opens between from and to
+	TotalOpens  int       `json:"total_opens"`
+	LastUsed    time.Time `json:"last_used"`
+	Hours       [24]int   `json:"hours"`
+	BusiestHour int       `json:"busiest_hour"`
+}
+
+// normalizeTrackedPath reduces a page URL or path to a clean path without
+// query string. Empty values mean the homepage.
+func normalizeTrackedPath(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		raw = u.Path
+	}
+	if raw == "" {
+		return "/"
+	}
+	p := path.Clean("/" + strings.TrimPrefix(raw, "/"))
+	if len(p) > maxTrackedPathLength {
+		p = p[:maxTrackedPathLength]
+	}
+	return p
+}
+
+// recordPage counts a view of a page
+func (v *VisitorStats) recordPage(page string) {
+	if v.PageStats == nil {
+		v.PageStats = make(map[string]int)
+	}
+	if _, ok := v.PageStats[page]; !ok && len(v.PageStats) >= maxTrackedPages {
+		page = otherBucket
+	}
+	v.PageStats[page]++
+}
+
+// recordAppOpen counts a click on an app tile
+func (v *VisitorStats) recordAppOpen(app string, t time.Time) {
+	if v.AppStats == nil {
+		v.AppStats = make(map[string]*AppUsage)
+	}
+	usage, ok := v.AppStats[app]
+	if !ok {
+		if len(v.AppStats) >= maxTrackedApps {
+			app = otherBucket
+		}
+		if usage, ok = v.AppStats[app]; !ok {
+			usage = &AppUsage{}
+			v.AppStats[app] = usage
+		}
+	}
+	if usage.Daily == nil {
+		usage.Daily = make(map[string]int)
+	}
+	usage.Opens++
+	usage.LastUsed = t
+	usage.Hours[t.Hour()]++
+	usage.Daily[t.Format(dayBucketLayout)]++
+}
+
+// appUsage summarizes the app opens in [from, to), most used first. Names
+// come from data/apps.json or the hardcoded homepage tiles.
+func (v *VisitorStats) appUsage(from, to time.Time) []appUsageSummary {
+	names := make(map[string]string, len(hardcodedAppNames))
+	for id, name := range hardcodedAppNames {
+		names[id] = name
+	}
+	if apps, err := loadApps(); err == nil {
+		for _, app := range apps {
+			names[app.ID] = app.Name
+		}
+	} else {
+		log.Printf("Error loading apps for visitor stats: %v", err)
+	}
+
+	fromKey, toKey := from.Format(dayBucketLayout), to.Format(dayBucketLayout)
+	summaries := []appUsageSummary{}
+	for id, usage := range v.AppStats {
+		summary := appUsageSummary{
+			ID:         id,
+			Name:       names[id],
+			TotalOpens: usage.Opens,
+			LastUsed:   usage.LastUsed,
+			Hours:      usage.Hours,
+		}
+		if summary.Name == "" {
+			summary.Name = id
+		}
+		for day, count := range usage.Daily {
+			if day >= fromKey && day < toKey {
+				summary.RangeOpens += count
+			}
+		}
+		for hour, count := range usage.Hours {
+			if count > usage.Hours[summary.BusiestHour] {
+				summary.BusiestHour = hour
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].RangeOpens != summaries[j].RangeOpens {
+			return summaries[i].RangeOpens > summaries[j].RangeOpens
+		}
+		return summaries[i].TotalOpens > summaries[j].TotalOpens
+	})
+	return summaries
+}
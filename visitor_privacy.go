@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	visitorSaltFile = "data/visitor_salt.json"
+
+	// The salt for hashed IPs is replaced after this long, so hashes from
+	// different days cannot be linked
+	visitorSaltRotation = 24 * time.Hour
+
+	// Visitors not seen for this long are removed (VISITOR_RETENTION_DAYS)
+	defaultVisitorRetentionDays = 90
+
+	// How stored visitor IPs are reduced (VISITOR_IP_MODE)
+	ipModeTruncate = "truncate" // IPv4 /24, IPv6 /48
+	ipModeHash     = "hash"     // HMAC with the rotating salt
+	ipModeFull     = "full"     // unchanged
+	ipModeNone     = "none"     // not stored
+
+	// Set by POST /api/visitor-opt-out
+	visitorOptOutCookieName = "visitor_opt_out"
+)
+
+// visitorIPMode returns the configured VISITOR_IP_MODE, truncate by default
+func visitorIPMode() string {
+	switch mode := strings.ToLower(os.Getenv("VISITOR_IP_MODE")); mode {
+	case ipModeHash, ipModeFull, ipModeNone:
+		return mode
+	default:
+		return ipModeTruncate
+	}
+}
+
+// visitorRetention returns how long visitor records are kept
+func visitorRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("VISITOR_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultVisitorRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// anonymizeIP reduces an address (optionally with a port) according to
+// VISITOR_IP_MODE. Values that are not IP addresses are returned unchanged.
+func anonymizeIP(addr string, now time.Time) string {
+	mode := visitorIPMode()
+	if mode == ipModeNone {
+		return ""
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+
+	switch mode {
+	case ipModeFull:
+		return ip.String()
+	case ipModeHash:
+		mac := hmac.New(sha256.New, visitorSalt.current(now))
+		mac.Write([]byte(ip.String()))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	default:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+}
+
+// rotatingSalt is the key for hashed IPs. It is persisted so hashes stay
+// stable across restarts until the next rotation.
+type rotatingSalt struct {
+	Salt      string    `json:"salt"` // hex encoded
+	CreatedAt time.Time `json:"created_at"`
+
+	mu     sync.Mutex
+	loaded bool
+}
+
+var visitorSalt = &rotatingSalt{}
+
+// current returns the salt, generating a new one when it is due for rotation
+func (s *rotatingSalt) current(now time.Time) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded {
+		s.loaded = true
+		if data, err := os.ReadFile(visitorSaltFile); err == nil {
+			if err := json.Unmarshal(data, s); err != nil {
+				log.Printf("Error loading visitor salt: %v", err)
+			}
+		}
+	}
+
+	salt, err := hex.DecodeString(s.Salt)
+	if err == nil && len(salt) > 0 && now.Sub(s.CreatedAt) < visitorSaltRotation {
+		return salt
+	}
+
+	salt = make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		log.Printf("Error generating visitor salt: %v", err)
+	}
+	s.Salt = hex.EncodeToString(salt)
+	s.CreatedAt = now
+
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = os.WriteFile(visitorSaltFile, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Error saving visitor salt: %v", err)
+	}
+	return salt
+}
+
+// trackingDisabled reports whether the visitor asked not to be tracked via
+// Do Not Track, Global Privacy Control or the opt-out cookie
+func trackingDisabled(r *http.Request) bool {
+	if r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" {
+		return true
+	}
+	c, err := r.Cookie(visitorOptOutCookieName)
+	return err == nil && c.Value == "1"
+}
+
+// pruneVisitors removes visitors last seen before the retention period and
+// returns how many were removed. Aggregated counters are kept.
+func (v *VisitorStats) pruneVisitors(now time.Time) int {
+	cutoff := now.Add(-visitorRetention())
+	removed := 0
+	for id, visitor := range v.UniqueVisitors {
+		if visitor.LastVisit.Before(cutoff) {
+			delete(v.UniqueVisitors, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// anonymizeStoredIPs applies VISITOR_IP_MODE to visitors recorded before it
+// was set. Already reduced values are left alone.
+func (v *VisitorStats) anonymizeStoredIPs(now time.Time) int {
+	changed := 0
+	for _, visitor := range v.UniqueVisitors {
+		if ip := anonymizeIP(visitor.IP, now); ip != visitor.IP {
+			visitor.IP = ip
+			changed++
+		}
+	}
+	return changed
+}
+
+// erase removes a visitor's record and writes the snapshot right away, so
+// the visitor's events do not stay in the event log
+func (a *visitorAggregator) erase(id string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stats == nil {
+		return false, nil
+	}
+	if _, ok := a.stats.UniqueVisitors[id]; !ok {
+		return false, nil
+	}
+	delete(a.stats.UniqueVisitors, id)
+	a.dirty = true
+	return true, a.flushLocked()
+}
+
+// VisitorOptOutHandler lets a visitor opt out of tracking (POST), which also
+// erases the data recorded under their visitor cookie, or opt in again (DELETE)
+func VisitorOptOutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		http.SetCookie(w, &http.Cookie{Name: visitorOptOutCookieName, Value: "", Path: "/", MaxAge: -1})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if c, err := r.Cookie("visitor_id"); err == nil && c.Value != "" {
+		if _, err := visitorStore.erase(c.Value); err != nil {
+			log.Printf("Error erasing visitor: %v", err)
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Failed to erase visitor data")), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: "visitor_id", Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorOptOutCookieName,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EraseVisitorHandler deletes everything stored about one visitor ID
+func EraseVisitorHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	found, err := visitorStore.erase(id)
+	if err != nil {
+		log.Printf("Error erasing visitor %s: %v", id, err)
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Failed to erase visitor data")), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Visitor not found")), http.StatusNotFound)
+		return
+	}
+
+	// The record itself is personal data, so only the ID is audited
+	writeAudit(r, "delete", "visitor", id, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// When a referrer map grows beyond maxReferrerEntries, all but the
+	// referrerEntriesKept most frequent entries are merged into otherBucket
+	maxReferrerEntries  = 500
+	referrerEntriesKept = 250
+
+	defaultTopReferrers = 10
+	maxTopReferrers     = 100
+)
+
+// namedCount is one entry of a top-N list
+type namedCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// internalHosts returns the host names from INTERNAL_HOSTS whose pages count
+// as internal navigation in addition to the server's own host
+func internalHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv("INTERNAL_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hostName strips the port from a host
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// normalizeReferrer reduces a referrer URL to host and path, dropping the
+// scheme, port, query and fragment. internal reports whether it is one of our
+// own pages: same host name as the request (ownHost) or in INTERNAL_HOSTS.
+// Returns "" for values that are not http(s) URLs.
+func normalizeReferrer(referrer, ownHost string) (key string, internal bool) {
+	u, err := url.Parse(strings.TrimSpace(referrer))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	p := "/"
+	if u.Path != "" {
+		p = path.Clean("/" + strings.TrimPrefix(u.Path, "/"))
+	}
+	if len(p) > maxTrackedPathLength {
+		p = p[:maxTrackedPathLength]
+	}
+
+	own := strings.TrimPrefix(strings.ToLower(hostName(ownHost)), "www.")
+	internal = own != "" && host == own
+	for _, h := range internalHosts() {
+		if host == strings.TrimPrefix(h, "www.") {
+			internal = true
+		}
+	}
+	if internal {
+		// Internal navigation is reported by page
+		return p, true
+	}
+	if p == "/" {
+		return host, false
+	}
+	return host + p, false
+}
+
+// recordReferrer counts a referrer in the external or internal referrer stats
+func (v *VisitorStats) recordReferrer(referrer, ownHost string) {
+	key, internal := normalizeReferrer(referrer, ownHost)
+	if key == "" {
+		return
+	}
+	counts := &v.ReferrerStats
+	if internal {
+		counts = &v.InternalReferrerStats
+	}
+	if *counts == nil {
+		*counts = make(map[string]int)
+	}
+	(*counts)[key]++
+	compactCounts(*counts)
+}
+
+// compactCounts merges the least frequent entries into otherBucket once the
+// map exceeds maxReferrerEntries
+func compactCounts(counts map[string]int) {
+	if len(counts) <= maxReferrerEntries {
+		return
+	}
+	entries := sortedCounts(counts)
+	for _, entry := range entries[referrerEntriesKept:] {
+		if entry.Name == otherBucket {
+			continue
+		}
+		counts[otherBucket] += entry.Count
+		delete(counts, entry.Name)
+	}
+}
+
+// sortedCounts returns the entries of counts, most frequent first
+func sortedCounts(counts map[string]int) []namedCount {
+	entries := make([]namedCount, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, namedCount{Name: name, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// topCounts returns the n most frequent entries; the rest, including an
+// existing otherBucket entry, are summed up in a final otherBucket entry
+func topCounts(counts map[string]int, n int) []namedCount {
+	top := []namedCount{}
+	other := counts[otherBucket]
+	for _, entry := range sortedCounts(counts) {
+		switch {
+		case entry.Name == otherBucket:
+		case len(top) < n:
+			top = append(top, entry)
+		default:
+			other += entry.Count
+		}
+	}
+	if other > 0 {
+		top = append(top, namedCount{Name: otherBucket, Count: other})
+	}
+	return top
+}
+
+// migrateReferrerStats normalizes referrers stored as full URLs before
+// normalizeReferrer existed. Their own host is unknown, so only
+// INTERNAL_HOSTS are recognized as internal. Reports whether anything changed.
+func (v *VisitorStats) migrateReferrerStats() bool {
+	changed := false
+	for key, count := range v.ReferrerStats {
+		if !strings.Contains(key, "://") {
+			continue
+		}
+		delete(v.ReferrerStats, key)
+		changed = true
+
+		normalized, internal := normalizeReferrer(key, "")
+		switch {
+		case normalized == "":
+			v.ReferrerStats[otherBucket] += count
+		case internal:
+			if v.InternalReferrerStats == nil {
+				v.InternalReferrerStats = make(map[string]int)
+			}
+			v.InternalReferrerStats[normalized] += count
+		default:
+			v.ReferrerStats[normalized] += count
+		}
+	}
+	if changed {
+		compactCounts(v.ReferrerStats)
+		compactCounts(v.InternalReferrerStats)
+	}
+	return changed
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	// Remembers the last month a report was sent for, so restarts do not
+	// send it twice
+	visitorReportStateFile = "data/visitor_report.json"
+
+	visitorReportCheckInterval = time.Hour
+	visitorReportTopApps       = 10
+	visitorReportTopHours      = 5
+)
+
+// visitorReportRecipients returns the addresses from VISITOR_REPORT_RECIPIENTS
+func visitorReportRecipients() []string {
+	var recipients []string
+	for _, address := range strings.Split(os.Getenv("VISITOR_REPORT_RECIPIENTS"), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			recipients = append(recipients, address)
+		}
+	}
+	return recipients
+}
+
+// monthlyVisitorReport is the content of the monthly usage email
+type monthlyVisitorReport struct {
+	Month       time.Time
+	Visits      int
+	NewVisitors int
+	Apps        []appUsageSummary
+	Hours       []namedCount // busiest hours of day, "8:00"
+	Days        []namedCount // visits per weekday, Monday first
+}
+
+// buildMonthlyVisitorReport summarizes the month starting at month
+func buildMonthlyVisitorReport(stats *VisitorStats, month time.Time) monthlyVisitorReport {
+	end := month.AddDate(0, 1, 0)
+	report := monthlyVisitorReport{
+		Month:  month,
+		Visits: stats.visitsBetween(month, end),
+	}
+
+	for _, visitor := range stats.UniqueVisitors {
+		if !visitor.FirstVisit.Before(month) && visitor.FirstVisit.Before(end) {
+			report.NewVisitors++
+		}
+	}
+
+	for _, app := range stats.appUsage(month, end) {
+		if app.RangeOpens == 0 || len(report.Apps) == visitorReportTopApps {
+			break
+		}
+		report.Apps = append(report.Apps, app)
+	}
+
+	var hours [24]int
+	for t := month; t.Before(end); t = t.Add(time.Hour) {
+		hours[t.Hour()] += stats.HourlyVisits[hourBucketKey(t)]
+	}
+	for hour, count := range hours {
+		if count > 0 {
+			report.Hours = append(report.Hours, namedCount{Name: fmt.Sprintf("%d:00", hour), Count: count})
+		}
+	}
+	sort.SliceStable(report.Hours, func(i, j int) bool { return report.Hours[i].Count > report.Hours[j].Count })
+	if len(report.Hours) > visitorReportTopHours {
+		report.Hours = report.Hours[:visitorReportTopHours]
+	}
+
+	var days [7]int
+	for t := month; t.Before(end); t = t.AddDate(0, 0, 1) {
+		days[weekdayIndex(t.Weekday())] += stats.DailyVisits[t.Format(dayBucketLayout)]
+	}
+	for i, count := range days {
+		report.Days = append(report.Days, namedCount{Name: czechDayNames[i], Count: count})
+	}
+	return report
+}
+
+// renderMonthlyVisitorReport formats the report as an HTML email body
+func renderMonthlyVisitorReport(report monthlyVisitorReport) string {
+	var b strings.Builder
+	table := func(title string, header [2]string, rows [][2]string) {
+		fmt.Fprintf(&b, `<h2 style="font-size:16px;color:#1e3a8a;margin:24px 0 8px">%s</h2>`, html.EscapeString(title))
+		if len(rows) == 0 {
+			b.WriteString(`<p style="color:#6b7280">Žádná data</p>`)
+			return
+		}
+		b.WriteString(`<table style="border-collapse:collapse;width:100%">`)
+		fmt.Fprintf(&b, `<tr><th style="text-align:left;border-bottom:1px solid #d1d5db;padding:4px">%s</th><th style="text-align:right;border-bottom:1px solid #d1d5db;padding:4px">%s</th></tr>`,
+			html.EscapeString(header[0]), html.EscapeString(header[1]))
+		for _, row := range rows {
+			fmt.Fprintf(&b, `<tr><td style="padding:4px">%s</td><td style="text-align:right;padding:4px">%s</td></tr>`,
+				html.EscapeString(row[0]), html.EscapeString(row[1]))
+		}
+		b.WriteString(`</table>`)
+	}
+	counts := func(entries []namedCount) [][2]string {
+		rows := make([][2]string, len(entries))
+		for i, entry := range entries {
+			rows[i] = [2]string{entry.Name, fmt.Sprint(entry.Count)}
+		}
+		return rows
+	}
+
+	b.WriteString(`<!DOCTYPE html><html><head><meta charset="UTF-8"></head><body style="font-family:Arial,sans-serif;color:#111827;max-width:600px;margin:0 auto;padding:16px">`)
+	fmt.Fprintf(&b, `<h1 style="font-size:20px;color:#1e3a8a">Využití intranetu – %s</h1>`, html.EscapeString(localeCzech.monthYear(report.Month)))
+
+	table("Souhrn", [2]string{"", ""}, [][2]string{
+		{"Návštěvy", fmt.Sprint(report.Visits)},
+		{"Noví návštěvníci", fmt.Sprint(report.NewVisitors)},
+	})
+
+	apps := make([][2]string, len(report.Apps))
+	for i, app := range report.Apps {
+		apps[i] = [2]string{app.Name, fmt.Sprint(app.RangeOpens)}
+	}
+	table("Nejpoužívanější aplikace", [2]string{"Aplikace", "Otevření"}, apps)
+	table("Nejrušnější hodiny", [2]string{"Hodina", "Návštěvy"}, counts(report.Hours))
+	table("Návštěvy podle dne v týdnu", [2]string{"Den", "Návštěvy"}, counts(report.Days))
+
+	b.WriteString(`<p style="color:#6b7280;font-size:12px;margin-top:24px">Poppe + Potthoff - Automaticky generovaný email</p></body></html>`)
+	return b.String()
+}
+
+// sendMonthlyVisitorReport emails the report for the month starting at month
+func sendMonthlyVisitorReport(month time.Time, recipients []string) error {
+	stats, err := visitorStore.snapshot()
+	if err != nil {
+		return err
+	}
+	report := buildMonthlyVisitorReport(stats, month)
+
+	d, sender, err := newMailDialer()
+	if err != nil {
+		return err
+	}
+	m := gomail.NewMessage()
+	m.SetHeader("From", sender)
+	m.SetHeader("To", recipients...)
+	m.SetHeader("Subject", "Měsíční přehled využití intranetu – "+localeCzech.monthYear(month))
+	m.SetBody("text/html", renderMonthlyVisitorReport(report))
+	return d.DialAndSend(m)
+}
+
+// checkMonthlyVisitorReport sends the report for the previous month once
+func checkMonthlyVisitorReport(now time.Time) {
+	recipients := visitorReportRecipients()
+	if len(recipients) == 0 || !mailEnabled() {
+		return
+	}
+	month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, now.Location())
+
+	var state struct {
+		LastSent string `json:"last_sent"` // YYYY-MM
+	}
+	if data, err := os.ReadFile(visitorReportStateFile); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Printf("Error loading visitor report state: %v", err)
+		}
+	}
+	if state.LastSent >= month.Format("2006-01") {
+		return
+	}
+
+	if err := sendMonthlyVisitorReport(month, recipients); err != nil {
+		// Retried at the next check
+		log.Printf("Error sending monthly visitor report: %v", err)
+		return
+	}
+	log.Printf("Sent monthly visitor report for %s to %d recipients", month.Format("2006-01"), len(recipients))
+
+	state.LastSent = month.Format("2006-01")
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.WriteFile(visitorReportStateFile, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Error saving visitor report state: %v", err)
+	}
+}
+
+// startMonthlyVisitorReport sends the report for the previous month after
+// the start of every month, when VISITOR_REPORT_RECIPIENTS is set
+func startMonthlyVisitorReport() {
+	go func() {
+		checkMonthlyVisitorReport(time.Now())
+		for range time.Tick(visitorReportCheckInterval) {
+			checkMonthlyVisitorReport(time.Now())
+		}
+	}()
+}
+
+// SendVisitorReportHandler sends the monthly report right away.
+// ?month=YYYY-MM selects the month, the previous month by default.
+func SendVisitorReportHandler(w http.ResponseWriter, r *http.Request) {
+	recipients := visitorReportRecipients()
+	if len(recipients) == 0 {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "VISITOR_REPORT_RECIPIENTS is not configured")), http.StatusBadRequest)
+		return
+	}
+	if !mailEnabled() {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "SMTP_PASSWORD is not configured")), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local)
+	if value := r.URL.Query().Get("month"); value != "" {
+		t, err := time.ParseInLocation("2006-01", value, time.Local)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Invalid month parameter")), http.StatusBadRequest)
+			return
+		}
+		month = t
+	}
+
+	if err := sendMonthlyVisitorReport(month, recipients); err != nil {
+		log.Printf("Error sending visitor report: %v", err)
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, tr(r, "Failed to send report")), http.StatusBadGateway)
+		return
+	}
+	writeAudit(r, "send", "visitor_report", month.Format("2006-01"), nil, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"month":      month.Format("2006-01"),
+		"recipients": recipients,
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+const (
+	// Hourly keys are in UTC, so every hour has its own key across DST
+	// changes; daily keys are in server local time
+	hourBucketLayout = "2006-01-02T15"
+	dayBucketLayout  = "2006-01-02"
+
+	// Hourly buckets are dropped after this long; daily buckets are kept
+	hourlyBucketRetention = 92 * 24 * time.Hour
+
+	granularityHour = "hour"
+	granularityDay  = "day"
+
+	// Upper bound of points in one series response
+	maxSeriesPoints = 5000
+)
+
+// visitSeriesPoint is the number of visits in the bucket starting at Start
+type visitSeriesPoint struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// recordBucket counts a visit at t in the hourly and daily buckets
+func (v *VisitorStats) recordBucket(t time.Time) {
+	if v.HourlyVisits == nil {
+		v.HourlyVisits = make(map[string]int)
+	}
+	if v.DailyVisits == nil {
+		v.DailyVisits = make(map[string]int)
+	}
+	v.HourlyVisits[hourBucketKey(t)]++
+	v.DailyVisits[t.Format(dayBucketLayout)]++
+}
+
+// hourBucketKey returns the key of the hourly bucket containing t
+func hourBucketKey(t time.Time) string {
+	return t.UTC().Format(hourBucketLayout)
+}
+
+// migrateHourlyBuckets rekeys hourly buckets recorded in local time to UTC.
+// The two local hours repeated when DST ends already share one bucket; it is
+// kept as the first of them. Reports whether the stats were changed.
+func (v *VisitorStats) migrateHourlyBuckets() bool {
+	if v.HourlyVisitsUTC {
+		return false
+	}
+	migrated := make(map[string]int, len(v.HourlyVisits))
+	for key, count := range v.HourlyVisits {
+		t, err := time.ParseInLocation(hourBucketLayout, key, time.Local)
+		if err != nil {
+			log.Printf("Dropping hourly bucket with invalid key %q", key)
+			continue
+		}
+		migrated[hourBucketKey(t)] += count
+	}
+	v.HourlyVisits = migrated
+	v.HourlyVisitsUTC = true
+	return true
+}
+
+// pruneHourlyBuckets drops hourly buckets older than hourlyBucketRetention
+// and returns how many were removed. Called on load and flush, not per visit.
+func (v *VisitorStats) pruneHourlyBuckets(now time.Time) int {
+	oldest := hourBucketKey(now.Add(-hourlyBucketRetention))
+	removed := 0
+	for key := range v.HourlyVisits {
+		// The layout sorts lexically in time order
+		if key < oldest {
+			delete(v.HourlyVisits, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// refreshTotals computes today's, this week's (from Monday) and this month's
+// visits from the daily buckets
+func (v *VisitorStats) refreshTotals(now time.Time) {
+	today := startOfDay(now)
+	weekStart := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+	tomorrow := today.AddDate(0, 0, 1)
+
+	v.TodayVisits = v.visitsBetween(today, tomorrow)
+	v.WeeklyVisits = v.visitsBetween(weekStart, tomorrow)
+	v.MonthlyVisits = v.visitsBetween(monthStart, tomorrow)
+}
+
+// visitsBetween sums the daily buckets of the days in [from, to)
+func (v *VisitorStats) visitsBetween(from, to time.Time) int {
+	fromKey, toKey := from.Format(dayBucketLayout), to.Format(dayBucketLayout)
+	total := 0
+	for key, count := range v.DailyVisits {
+		if key >= fromKey && key < toKey {
+			total += count
+		}
+	}
+	return total
+}
+
+// series returns the visits in [from, to) per hour or day, including empty
+// buckets. Hourly data is only available for the retention period. Hours are
+// stepped in absolute time, so a day with a DST change has 23 or 25 points.
+func (v *VisitorStats) series(from, to time.Time, granularity string) ([]visitSeriesPoint, error) {
+	var step func(time.Time) time.Time
+	var key func(time.Time) string
+	var buckets map[string]int
+
+	switch granularity {
+	case granularityHour:
+		from = from.Truncate(time.Hour)
+		step = func(t time.Time) time.Time { return t.Add(time.Hour) }
+		key, buckets = hourBucketKey, v.HourlyVisits
+	case granularityDay:
+		from = startOfDay(from)
+		step = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+		key = func(t time.Time) string { return t.Format(dayBucketLayout) }
+		buckets = v.DailyVisits
+	default:
+		return nil, errors.New("granularity must be hour or day")
+	}
+
+	points := []visitSeriesPoint{}
+	for t := from; t.Before(to); t = step(t) {
+		if len(points) == maxSeriesPoints {
+			return nil, errors.New("range is too large for this granularity")
+		}
+		points = append(points, visitSeriesPoint{Start: t, Count: buckets[key(t)]})
+	}
+	return points, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// parseStatsTime accepts RFC 3339 timestamps or dates (YYYY-MM-DD, local time).
+// Dates used as the end of a range include the whole day.
+func parseStatsTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Local(), nil
+	}
+	t, err := time.ParseInLocation(dayBucketLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// statsRange reads the ?from=, ?to= and ?granularity= parameters of the visitor
+// stats endpoints. The default is the last 30 days by day.
+func statsRange(q url.Values, now time.Time) (from, to time.Time, granularity string, err error) {
+	from = startOfDay(now).AddDate(0, 0, -29)
+	to = startOfDay(now).AddDate(0, 0, 1)
+	granularity = q.Get("granularity")
+	if granularity == "" {
+		granularity = granularityDay
+	}
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := q.Get(name); value != "" {
+			t, parseErr := parseStatsTime(value, name == "to")
+			if parseErr != nil {
+				return from, to, granularity, fmt.Errorf("Invalid %s parameter", name)
+			}
+			*target = t
+		}
+	}
+	if !from.Before(to) {
+		return from, to, granularity, errors.New("from must be before to")
+	}
+	return from, to, granularity, nil
+}
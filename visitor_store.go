@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Append-only log of visits not yet contained in visitorStatsFile. It is
+	// replayed on startup and truncated after every snapshot.
+	visitEventsFile = "data/visits.log"
+
+	visitorStatsFlushInterval = 30 * time.Second
+)
+
+// visitEvent is one tracked page view or app tile click
+type visitEvent struct {
+	Time      time.Time `json:"time"`
+	VisitorID string    `json:"visitor_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Referrer  string    `json:"referrer,omitempty"`
+	Host      string    `json:"host,omitempty"` // Host header, tells internal referrers apart
+	Path      string    `json:"path,omitempty"`
+	App       string    `json:"app,omitempty"`      // set for app tile clicks
+	Excluded  string    `json:"excluded,omitempty"` // see visitExclusion
+	// Position in the event stream, compared with VisitorStats.LastEventSeq
+	// on replay. Zero for events logged before it was introduced.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// visitorAggregator keeps the visitor stats in memory. Visits are applied
+// under a mutex and appended to the event log; the full snapshot is only
+// written periodically and on shutdown instead of on every page view.
+type visitorAggregator struct {
+	mu     sync.Mutex
+	stats  *VisitorStats
+	events *os.File
+	dirty  bool
+}
+
+var visitorStore = &visitorAggregator{}
+
+// load reads the snapshot and replays visits logged after it was written
+func (a *visitorAggregator) load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats, err := loadVisitorStats()
+	if err != nil {
+		return err
+	}
+	stats.init()
+	a.stats = stats
+
+	// Reclassify visits recorded with an older User-Agent parser; replayed
+	// events already use the current one
+	if a.stats.migrateUserAgentStats() {
+		log.Printf("Migrated visitor stats to User-Agent parser version %d", userAgentParserVersion)
+		a.dirty = true
+	}
+
+	if a.stats.migrateReferrerStats() {
+		log.Printf("Normalized stored referrers")
+		a.dirty = true
+	}
+
+	// Before replay, which records into UTC buckets
+	if a.stats.migrateHourlyBuckets() {
+		log.Printf("Rekeyed %d hourly visit buckets to UTC", len(a.stats.HourlyVisits))
+		a.dirty = true
+	}
+
+	// Stats from before the buckets only have running totals: the old
+	// counters were never reset, so they cannot be split into days
+	if len(a.stats.DailyVisits) == 0 && a.stats.TotalVisits > 0 {
+		log.Printf("Visitor stats have no daily buckets: today's, weekly and monthly visits and the series start now; the %d total visits are kept", a.stats.TotalVisits)
+	}
+
+	replayed, err := a.replayEvents()
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d visits from %s", replayed, visitEventsFile)
+		a.dirty = true
+	}
+
+	// Apply the privacy settings to data recorded before they changed
+	now := time.Now()
+	if changed := a.stats.anonymizeStoredIPs(now); changed > 0 {
+		log.Printf("Anonymized stored IPs of %d visitors (VISITOR_IP_MODE=%s)", changed, visitorIPMode())
+		a.dirty = true
+	}
+	if removed := a.stats.pruneVisitors(now); removed > 0 {
+		log.Printf("Removed %d visitors past the retention period", removed)
+		a.dirty = true
+	}
+	if a.stats.pruneHourlyBuckets(now) > 0 {
+		a.dirty = true
+	}
+
+	if err := os.MkdirAll(filepath.Dir(visitEventsFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	a.events, err = os.OpenFile(visitEventsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", visitEventsFile, err)
+	}
+	return nil
+}
+
+// replayEvents applies logged visits. Callers must hold a.mu.
+func (a *visitorAggregator) replayEvents() (int, error) {
+	f, err := os.Open(visitEventsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open %s: %w", visitEventsFile, err)
+	}
+	defer f.Close()
+
+	// Events up to the snapshot's LastEventSeq are already counted; this
+	// happens when the process stopped between writing the snapshot and
+	// truncating the log. Events without a sequence number fall back to the
+	// snapshot's last visit.
+	var snapshotTime time.Time
+	if _, err := os.Stat(visitorStatsFile); err == nil && a.stats.TotalVisits > 0 {
+		snapshotTime = a.stats.LastVisit
+	}
+
+	replayed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e visitEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A crash can leave a partial last line
+			log.Printf("Skipping malformed visit event: %v", err)
+			continue
+		}
+		if e.Seq != 0 {
+			if e.Seq <= a.stats.LastEventSeq {
+				continue
+			}
+			a.stats.LastEventSeq = e.Seq
+		} else if !e.Time.After(snapshotTime) {
+			continue
+		}
+		a.stats.applyVisit(e)
+		replayed++
+	}
+	return replayed, scanner.Err()
+}
+
+// track records a visit in memory and in the event log
+func (a *visitorAggregator) track(e visitEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stats == nil {
+		a.stats = &VisitorStats{}
+		a.stats.init()
+	}
+	a.stats.LastEventSeq++
+	e.Seq = a.stats.LastEventSeq
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error marshaling visit event: %v", err)
+		return
+	}
+	a.stats.applyVisit(e)
+	a.dirty = true
+
+	if a.events != nil {
+		if _, err := a.events.Write(append(line, '\n')); err != nil {
+			log.Printf("Error writing visit event: %v", err)
+		}
+	}
+}
+
+// snapshot returns a copy of the stats that callers may modify
+func (a *visitorAggregator) snapshot() (*VisitorStats, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stats == nil {
+		return loadVisitorStats()
+	}
+	data, err := json.Marshal(a.stats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal visitor stats: %w", err)
+	}
+	stats := &VisitorStats{}
+	if err := json.Unmarshal(data, stats); err != nil {
+		return nil, fmt.Errorf("failed to copy visitor stats: %w", err)
+	}
+	return stats, nil
+}
+
+// flush removes visitors and hourly buckets past their retention period,
+// writes the snapshot if anything changed and empties the event log, whose
+// visits are now part of the snapshot
+func (a *visitorAggregator) flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.flushLocked()
+}
+
+// flushLocked is flush for callers holding a.mu
+func (a *visitorAggregator) flushLocked() error {
+	if a.stats == nil {
+		return nil
+	}
+	now := time.Now()
+	if a.stats.pruneVisitors(now) > 0 {
+		a.dirty = true
+	}
+	if a.stats.pruneHourlyBuckets(now) > 0 {
+		a.dirty = true
+	}
+	if !a.dirty {
+		return nil
+	}
+	if err := saveVisitorStats(a.stats); err != nil {
+		return err
+	}
+	a.dirty = false
+
+	if a.events != nil {
+		if err := a.events.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate %s: %w", visitEventsFile, err)
+		}
+	}
+	return nil
+}
+
+// close flushes the stats and closes the event log
+func (a *visitorAggregator) close() error {
+	err := a.flush()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.events != nil {
+		a.events.Close()
+		a.events = nil
+	}
+	return err
+}
+
+// startVisitorStatsFlush writes the visitor stats every visitorStatsFlushInterval
+func startVisitorStatsFlush() {
+	go func() {
+		for range time.Tick(visitorStatsFlushInterval) {
+			if err := visitorStore.flush(); err != nil {
+				log.Printf("Error saving visitor stats: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const benchmarkVisitors = 5000
+
+// useTempDataDir runs the test in an empty directory, so data/ files of the
+// test do not touch the working tree
+func useTempDataDir(tb testing.TB) {
+	tb.Helper()
+	tb.Chdir(tb.TempDir())
+	if err := os.MkdirAll("data", 0755); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func testVisit(visitorID string, t time.Time) visitEvent {
+	return visitEvent{
+		Time:      t,
+		VisitorID: visitorID,
+		IP:        "192.0.2.0",
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		Path:      "/",
+	}
+}
+
+// seedVisitorStats writes a snapshot with n known visitors
+func seedVisitorStats(tb testing.TB, n int) {
+	tb.Helper()
+	stats := &VisitorStats{}
+	stats.init()
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		stats.applyVisit(testVisit(fmt.Sprintf("visitor-%d", i), now))
+	}
+	if err := saveVisitorStats(stats); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// BenchmarkTrackVisit compares recording a visit by reading, updating and
+// rewriting the whole stats file with visitorAggregator.track
+func BenchmarkTrackVisit(b *testing.B) {
+	b.Run("load-save", func(b *testing.B) {
+		useTempDataDir(b)
+		seedVisitorStats(b, benchmarkVisitors)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			stats, err := loadVisitorStats()
+			if err != nil {
+				b.Fatal(err)
+			}
+			stats.applyVisit(testVisit(fmt.Sprintf("visitor-%d", i%benchmarkVisitors), time.Now()))
+			if err := saveVisitorStats(stats); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("aggregator", func(b *testing.B) {
+		useTempDataDir(b)
+		seedVisitorStats(b, benchmarkVisitors)
+		a := &visitorAggregator{}
+		if err := a.load(); err != nil {
+			b.Fatal(err)
+		}
+		defer a.close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.track(testVisit(fmt.Sprintf("visitor-%d", i%benchmarkVisitors), time.Now()))
+		}
+	})
+}
+
+func TestTrackConcurrent(t *testing.T) {
+	useTempDataDir(t)
+	a := &visitorAggregator{}
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	const workers, visits = 8, 250
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < visits; i++ {
+				a.track(testVisit(fmt.Sprintf("visitor-%d", w), time.Now()))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats, err := a.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalVisits != workers*visits {
+		t.Errorf("TotalVisits = %d, want %d", stats.TotalVisits, workers*visits)
+	}
+	for w := 0; w < workers; w++ {
+		if got := stats.UniqueVisitors[fmt.Sprintf("visitor-%d", w)].Visits; got != visits {
+			t.Errorf("visitor-%d has %d visits, want %d", w, got, visits)
+		}
+	}
+	if got := stats.visitsBetween(startOfDay(time.Now()), startOfDay(time.Now()).AddDate(0, 0, 1)); got != workers*visits {
+		t.Errorf("daily buckets hold %d visits, want %d", got, workers*visits)
+	}
+
+	// Every visit is logged once with its own sequence number
+	f, err := os.Open(visitEventsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	seen := make(map[uint64]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e visitEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if seen[e.Seq] {
+			t.Errorf("sequence number %d logged twice", e.Seq)
+		}
+		seen[e.Seq] = true
+	}
+	if len(seen) != workers*visits {
+		t.Errorf("logged %d events, want %d", len(seen), workers*visits)
+	}
+}
+
+// TestReplayAfterCrashBeforeTruncate stops the process between writing the
+// snapshot and truncating the event log: events in the snapshot must not be
+// counted twice, later ones must be replayed
+func TestReplayAfterCrashBeforeTruncate(t *testing.T) {
+	useTempDataDir(t)
+	a := &visitorAggregator{}
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	a.track(testVisit("alice", now))
+	a.track(testVisit("bob", now))
+	// App clicks and bots do not advance LastVisit
+	a.track(visitEvent{Time: now, VisitorID: "alice", App: "lunch"})
+	a.track(visitEvent{Time: now, UserAgent: "Googlebot/2.1", Excluded: exclusionBot})
+
+	// Snapshot written, log not truncated
+	a.mu.Lock()
+	if err := saveVisitorStats(a.stats); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Unlock()
+
+	// Logged after the snapshot, with the same timestamp
+	a.track(testVisit("carol", now))
+	a.track(visitEvent{Time: now, VisitorID: "carol", App: "lunch"})
+	a.track(visitEvent{Time: now, UserAgent: "curl/8.0", Excluded: exclusionBot})
+
+	want, err := a.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Crash: the event log is left as it is
+	a.events.Close()
+
+	restarted := &visitorAggregator{}
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.close()
+	got, err := restarted.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.TotalVisits != 3 || got.TotalVisits != want.TotalVisits {
+		t.Errorf("TotalVisits = %d, want %d", got.TotalVisits, want.TotalVisits)
+	}
+	if got.AppStats["lunch"].Opens != 2 {
+		t.Errorf("lunch opens = %d, want 2", got.AppStats["lunch"].Opens)
+	}
+	if got.BotVisits != 2 {
+		t.Errorf("BotVisits = %d, want 2", got.BotVisits)
+	}
+	if len(got.UniqueVisitors) != 3 {
+		t.Errorf("%d unique visitors, want 3", len(got.UniqueVisitors))
+	}
+	if got.LastEventSeq != want.LastEventSeq {
+		t.Errorf("LastEventSeq = %d, want %d", got.LastEventSeq, want.LastEventSeq)
+	}
+}